@@ -0,0 +1,101 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	tokenPrefix = "gmc"
+	secretSize  = 32
+
+	ScopeWrite = "write"
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+	// ScopeSync - not a permission, marks keys whose writes are acknowledged only after commit
+	ScopeSync = "sync"
+)
+
+var (
+	ErrMalformedToken = errors.New("malformed API key")
+	ErrInvalidKey     = errors.New("invalid API key")
+	ErrExpiredKey     = errors.New("API key expired")
+	ErrRevokedKey     = errors.New("API key revoked")
+	ErrKeyNotFound    = errors.New("API key not found")
+	ErrUnknownScope   = errors.New("unknown scope")
+)
+
+// Key - stored API key, secret itself is never stored, only its hash
+type Key struct {
+	ID          uuid.UUID   `json:"id"`
+	Name        string      `json:"name"`
+	SecretHash  []byte      `json:"-"`
+	Scopes      []string    `json:"scopes"`
+	DeviceIDs   []uuid.UUID `json:"deviceIds"`
+	DeviceGroup *string     `json:"deviceGroup,omitempty"`
+	ExpiresAt   *time.Time  `json:"expiresAt,omitempty"`
+	RevokedAt   *time.Time  `json:"revokedAt,omitempty"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	RotatedAt   *time.Time  `json:"rotatedAt,omitempty"`
+}
+
+// Check - verifies secret and key state at given moment
+func (k *Key) Check(secret string, now time.Time) error {
+	if subtle.ConstantTimeCompare(hashSecret(secret), k.SecretHash) != 1 {
+		return ErrInvalidKey
+	}
+	if k.RevokedAt != nil {
+		return ErrRevokedKey
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return ErrExpiredKey
+	}
+	return nil
+}
+
+func ValidateScopes(scopes []string) error {
+	for _, s := range scopes {
+		switch s {
+		case ScopeWrite, ScopeRead, ScopeAdmin, ScopeSync:
+		default:
+			return ErrUnknownScope
+		}
+	}
+	return nil
+}
+
+// newToken - generates token in form gmc_<key id>_<secret> and hash of its secret
+func newToken(id uuid.UUID) (string, []byte, error) {
+	raw := make([]byte, secretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	token := tokenPrefix + "_" + strings.ReplaceAll(id.String(), "-", "") + "_" + secret
+	return token, hashSecret(secret), nil
+}
+
+// ParseToken - splits token into key id and secret
+func ParseToken(token string) (uuid.UUID, string, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != tokenPrefix || parts[2] == "" {
+		return uuid.Nil, "", ErrMalformedToken
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return uuid.Nil, "", ErrMalformedToken
+	}
+	return id, parts[2], nil
+}
+
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
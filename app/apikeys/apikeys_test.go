@@ -0,0 +1,87 @@
+package apikeys
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func newCachedKey(t *testing.T, s *Store, scopes ...string) (*Key, string) {
+	key := &Key{ID: uuid.New(), Scopes: scopes}
+	token, hash, err := newToken(key.ID)
+	require.NoError(t, err)
+	key.SecretHash = hash
+	s.put(*key)
+	return key, token
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	s := NewStore(nil, Config{Enabled: true})
+	key, token := newCachedKey(t, s, ScopeWrite)
+
+	id, _, err := ParseToken(token)
+	require.NoError(t, err)
+	require.Equal(t, key.ID, id)
+
+	got, err := s.Authenticate(token)
+	require.NoError(t, err)
+	require.True(t, got.HasScope(ScopeWrite))
+	require.False(t, got.HasScope(ScopeAdmin))
+
+	_, err = s.Authenticate(token + "x")
+	require.Equal(t, ErrInvalidKey, err)
+	_, err = s.Authenticate("Bearer something")
+	require.Equal(t, ErrMalformedToken, err)
+}
+
+func TestKeyCheck(t *testing.T) {
+	s := NewStore(nil, Config{Enabled: true})
+	key, token := newCachedKey(t, s, ScopeAdmin)
+	require.True(t, newKeyPrincipal(key, nil).HasScope(ScopeRead))
+	_, secret, err := ParseToken(token)
+	require.NoError(t, err)
+
+	now := time.Now()
+	past := now.Add(-time.Second)
+	key.ExpiresAt = &past
+	require.Equal(t, ErrExpiredKey, key.Check(secret, now))
+
+	key.ExpiresAt = nil
+	key.RevokedAt = &past
+	require.Equal(t, ErrRevokedKey, key.Check(secret, now))
+}
+
+func TestValidateScopes(t *testing.T) {
+	require.NoError(t, ValidateScopes([]string{ScopeRead, ScopeWrite}))
+	require.Equal(t, ErrUnknownScope, ValidateScopes([]string{"root"}))
+	require.NoError(t, ValidateScopes([]string{ScopeWrite, ScopeSync}))
+}
+
+func TestPrincipalWriteThrough(t *testing.T) {
+	require.True(t, NewPrincipal(uuid.New(), []string{ScopeWrite, ScopeSync}, nil).WriteThrough())
+	require.False(t, NewPrincipal(uuid.New(), []string{ScopeAdmin}, nil).WriteThrough())
+}
+
+func TestPrincipalDevices(t *testing.T) {
+	bound, member, other := uuid.New(), uuid.New(), uuid.New()
+	groups := map[string][]uuid.UUID{"meters": {member}}
+
+	p := newKeyPrincipal(&Key{ID: uuid.New()}, groups)
+	require.True(t, p.CanAccessDevice(other))
+
+	p = newKeyPrincipal(&Key{ID: uuid.New(), DeviceIDs: []uuid.UUID{bound}}, groups)
+	require.True(t, p.CanAccessDevice(bound))
+	require.False(t, p.CanAccessDevice(other))
+
+	group := "meters"
+	p = newKeyPrincipal(&Key{ID: uuid.New(), DeviceIDs: []uuid.UUID{bound}, DeviceGroup: &group}, groups)
+	require.True(t, p.CanAccessDevice(bound))
+	require.True(t, p.CanAccessDevice(member))
+	require.False(t, p.CanAccessDevice(other))
+
+	empty := "empty"
+	p = newKeyPrincipal(&Key{ID: uuid.New(), DeviceGroup: &empty}, groups)
+	require.False(t, p.CanAccessDevice(other))
+}
@@ -0,0 +1,82 @@
+package apikeys
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// ContextKey - key under which auth middleware stores resolved Principal
+const ContextKey = "principal"
+
+// Principal - identity resolved from API key, restricts which devices the key may access
+type Principal struct {
+	KeyID   uuid.UUID
+	Scopes  []string
+	Group   string
+	devices map[uuid.UUID]struct{}
+}
+
+// NewPrincipal - principal bound to given devices, empty devices mean any device
+func NewPrincipal(keyID uuid.UUID, scopes []string, devices []uuid.UUID) *Principal {
+	p := &Principal{KeyID: keyID, Scopes: scopes}
+	if len(devices) > 0 {
+		p.devices = make(map[uuid.UUID]struct{}, len(devices))
+		for _, id := range devices {
+			p.devices[id] = struct{}{}
+		}
+	}
+	return p
+}
+
+// newKeyPrincipal - key is bound to union of its devices and members of its group,
+// key with group but without members can't access any device
+func newKeyPrincipal(k *Key, groups map[string][]uuid.UUID) *Principal {
+	devices := k.DeviceIDs
+	if k.DeviceGroup != nil {
+		devices = append(append(make([]uuid.UUID, 0, len(devices)), devices...), groups[*k.DeviceGroup]...)
+	}
+	p := NewPrincipal(k.ID, k.Scopes, devices)
+	if k.DeviceGroup != nil {
+		p.Group = *k.DeviceGroup
+		if p.devices == nil {
+			p.devices = map[uuid.UUID]struct{}{}
+		}
+	}
+	return p
+}
+
+// HasScope - admin scope implies every other scope
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteThrough - reports whether writes of principal are acknowledged only after commit,
+// unlike other scopes it is not implied by admin
+func (p *Principal) WriteThrough() bool {
+	for _, s := range p.Scopes {
+		if s == ScopeSync {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccessDevice - reports whether principal may write or read data of device
+func (p *Principal) CanAccessDevice(id uuid.UUID) bool {
+	if p.devices == nil {
+		return true
+	}
+	_, ok := p.devices[id]
+	return ok
+}
+
+// FromContext - returns principal stored by auth middleware or nil if authentication is disabled
+func FromContext(c *fiber.Ctx) *Principal {
+	p, _ := c.Locals(ContextKey).(*Principal)
+	return p
+}
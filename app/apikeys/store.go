@@ -0,0 +1,317 @@
+package apikeys
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	db "github.com/qwlt/gmcollector/app/db"
+	"github.com/spf13/viper"
+)
+
+var store *Store
+
+const selectKeys = `SELECT id, name, secret_hash, scopes, device_ids, device_group, expires_at, revoked_at, created_at, rotated_at FROM api_keys`
+
+// Config - API keys settings, read from `auth` section
+// Enabled - if false every request is allowed without key
+// CacheTTL - period of reloading keys from database into memory
+type Config struct {
+	Enabled  bool          `mapstructure:"enabled"`
+	CacheTTL time.Duration `mapstructure:"cacheTTL"`
+}
+
+// Store - API keys kept in postgres and cached in memory,
+// requests are authenticated against cache only
+type Store struct {
+	pool   *pgxpool.Pool
+	conf   Config
+	mu     sync.RWMutex
+	cache  map[uuid.UUID]cachedKey
+	groups map[string][]uuid.UUID
+}
+
+type cachedKey struct {
+	key       Key
+	principal *Principal
+}
+
+func NewStore(pool *pgxpool.Pool, conf Config) *Store {
+	if conf.CacheTTL <= 0 {
+		conf.CacheTTL = 30 * time.Second
+	}
+	return &Store{pool: pool, conf: conf, cache: make(map[uuid.UUID]cachedKey), groups: make(map[string][]uuid.UUID)}
+}
+
+// GetStore - returns store initialized from `auth` config section with warmed cache
+func GetStore() (*Store, error) {
+	if store == nil {
+		conf := Config{}
+		if viper.IsSet("auth") {
+			if err := viper.UnmarshalKey("auth", &conf); err != nil {
+				return nil, err
+			}
+		}
+		s := NewStore(db.GetDB(), conf)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := s.Refresh(ctx); err != nil {
+			return nil, err
+		}
+		go s.refreshLoop()
+		store = s
+	}
+	return store, nil
+}
+
+func (s *Store) Enabled() bool {
+	return s.conf.Enabled
+}
+
+// Refresh - replaces cache with keys currently stored in database
+func (s *Store) Refresh(ctx context.Context) error {
+	keys, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	groups, err := s.Groups(ctx)
+	if err != nil {
+		return err
+	}
+	cache := make(map[uuid.UUID]cachedKey, len(keys))
+	for i := range keys {
+		cache[keys[i].ID] = cachedKey{key: keys[i], principal: newKeyPrincipal(&keys[i], groups)}
+	}
+	s.mu.Lock()
+	s.cache = cache
+	s.groups = groups
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Store) refreshLoop() {
+	ticker := time.NewTicker(s.conf.CacheTTL)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), s.conf.CacheTTL)
+		if err := s.Refresh(ctx); err != nil {
+			log.Printf("Cant refresh API keys cache: %v", err)
+		}
+		cancel()
+	}
+}
+
+// Authenticate - resolves token into principal using cache
+func (s *Store) Authenticate(token string) (*Principal, error) {
+	id, secret, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	entry, ok := s.cache[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+	if err := entry.key.Check(secret, time.Now()); err != nil {
+		return nil, err
+	}
+	return entry.principal, nil
+}
+
+// Validator - implementation of middlewares.Config.Validator
+func (s *Store) Validator(c *fiber.Ctx, token string) (bool, error) {
+	if _, err := s.Authenticate(token); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Resolver - implementation of middlewares.Config.Resolver, stores *Principal into context
+func (s *Store) Resolver(c *fiber.Ctx, token string) (interface{}, error) {
+	return s.Authenticate(token)
+}
+
+// Create - stores new key and returns it along with token, token can't be recovered later
+func (s *Store) Create(ctx context.Context, name string, scopes []string, deviceIDs []uuid.UUID, deviceGroup *string, expiresAt *time.Time) (*Key, string, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+	if scopes == nil {
+		scopes = []string{}
+	}
+	if deviceIDs == nil {
+		deviceIDs = []uuid.UUID{}
+	}
+	key := &Key{ID: uuid.New(), Name: name, Scopes: scopes, DeviceIDs: deviceIDs, DeviceGroup: deviceGroup, ExpiresAt: expiresAt}
+	token, hash, err := newToken(key.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	key.SecretHash = hash
+	err = s.pool.QueryRow(ctx,
+		`INSERT INTO api_keys (id, name, secret_hash, scopes, device_ids, device_group, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at`,
+		key.ID, key.Name, key.SecretHash, key.Scopes, uuidStrings(key.DeviceIDs), key.DeviceGroup, key.ExpiresAt,
+	).Scan(&key.CreatedAt)
+	if err != nil {
+		return nil, "", err
+	}
+	s.put(*key)
+	return key, token, nil
+}
+
+func (s *Store) List(ctx context.Context) ([]Key, error) {
+	rows, err := s.pool.Query(ctx, selectKeys+` ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]Key, 0)
+	for rows.Next() {
+		k, err := scanKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *Store) Get(ctx context.Context, id uuid.UUID) (*Key, error) {
+	k, err := scanKey(s.pool.QueryRow(ctx, selectKeys+` WHERE id = $1`, id))
+	if err == pgx.ErrNoRows {
+		return nil, ErrKeyNotFound
+	}
+	return k, err
+}
+
+// Rotate - replaces secret of active key, previous token stops working immediately
+func (s *Store) Rotate(ctx context.Context, id uuid.UUID) (string, error) {
+	token, hash, err := newToken(id)
+	if err != nil {
+		return "", err
+	}
+	tag, err := s.pool.Exec(ctx, `UPDATE api_keys SET secret_hash = $2, rotated_at = now() WHERE id = $1 AND revoked_at IS NULL`, id, hash)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrKeyNotFound
+	}
+	return token, s.reload(ctx, id)
+}
+
+func (s *Store) Revoke(ctx context.Context, id uuid.UUID) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrKeyNotFound
+	}
+	return s.reload(ctx, id)
+}
+
+func (s *Store) reload(ctx context.Context, id uuid.UUID) error {
+	k, err := s.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.put(*k)
+	return nil
+}
+
+func (s *Store) put(k Key) {
+	s.mu.Lock()
+	s.cache[k.ID] = cachedKey{key: k, principal: newKeyPrincipal(&k, s.groups)}
+	s.mu.Unlock()
+}
+
+// Groups - returns members of every device group
+func (s *Store) Groups(ctx context.Context) (map[string][]uuid.UUID, error) {
+	rows, err := s.pool.Query(ctx, `SELECT group_name, uid::text FROM device_groups ORDER BY group_name, uid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := make(map[string][]uuid.UUID)
+	for rows.Next() {
+		var name, uid string
+		if err := rows.Scan(&name, &uid); err != nil {
+			return nil, err
+		}
+		id, err := uuid.Parse(uid)
+		if err != nil {
+			return nil, err
+		}
+		groups[name] = append(groups[name], id)
+	}
+	return groups, rows.Err()
+}
+
+// SetGroup - replaces members of device group and refreshes cache,
+// so keys bound to the group see new members immediately
+func (s *Store) SetGroup(ctx context.Context, name string, deviceIDs []uuid.UUID) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	if _, err := tx.Exec(ctx, `DELETE FROM device_groups WHERE group_name = $1`, name); err != nil {
+		return err
+	}
+	if len(deviceIDs) > 0 {
+		_, err := tx.Exec(ctx, `INSERT INTO device_groups (group_name, uid) SELECT $1, unnest($2::uuid[]) ON CONFLICT DO NOTHING`, name, uuidStrings(deviceIDs))
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	return s.Refresh(ctx)
+}
+
+func scanKey(row pgx.Row) (*Key, error) {
+	k := &Key{}
+	var deviceIDs []string
+	err := row.Scan(&k.ID, &k.Name, &k.SecretHash, &k.Scopes, &deviceIDs, &k.DeviceGroup, &k.ExpiresAt, &k.RevokedAt, &k.CreatedAt, &k.RotatedAt)
+	if err != nil {
+		return nil, err
+	}
+	k.DeviceIDs = make([]uuid.UUID, 0, len(deviceIDs))
+	for _, s := range deviceIDs {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		k.DeviceIDs = append(k.DeviceIDs, id)
+	}
+	return k, nil
+}
+
+// uuidStrings - uuid arrays are passed to pgx as text to avoid treating uuid as byte array
+func uuidStrings(ids []uuid.UUID) []string {
+	s := make([]string, len(ids))
+	for i := range ids {
+		s[i] = ids[i].String()
+	}
+	return s
+}
+
+// RequireScope - rejects request with 403 unless principal has given scope,
+// requests without principal are passed as authentication is disabled for them
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		p := FromContext(c)
+		if p == nil || p.HasScope(scope) {
+			return c.Next()
+		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"errors": "API key has no `" + scope + "` scope"})
+	}
+}
@@ -1,16 +1,23 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v4/pgxpool"
 	cfg "github.com/qwlt/gmcollector/app/config"
 	"github.com/qwlt/gmcollector/app/db"
+	"github.com/qwlt/gmcollector/app/metrics"
+	"github.com/qwlt/gmcollector/app/migrations"
+	"github.com/qwlt/gmcollector/app/mqtt"
+	"github.com/qwlt/gmcollector/app/partitions"
 	"github.com/qwlt/gmcollector/app/server"
+	"github.com/qwlt/gmcollector/app/stream"
 	wb "github.com/qwlt/gmcollector/app/writebuffer"
 	"github.com/spf13/viper"
 )
@@ -29,6 +36,8 @@ type Application struct {
 	Server         *fiber.App
 	WriteBuffer    *wb.WriteBuffer
 	PGPool         *pgxpool.Pool
+	MQTT           *mqtt.Subscriber
+	Partitions     *partitions.Manager
 	ConfigProvider string
 }
 
@@ -45,31 +54,101 @@ func (app *Application) InitWriteBuffer() error {
 		panic(err)
 	}
 	app.WriteBuffer = wb
+	metrics.RegisterBuffer(wb)
+	wb.AddObserver(stream.GetHub())
+	if err := wb.ReplayWAL(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// cache is filled by incoming datapoints anyway, so collector starts with cold one
+	if err := wb.Latest().Warm(ctx, app.PGPool, wb.Conf.TableName, time.Now().Add(-wb.WarmWindow())); err != nil {
+		log.Printf("Cant warm latest values cache, starting with cold one: %v", err)
+		return nil
+	}
+	log.Printf("Latest values cache warmed with %v devices", wb.Latest().Len())
 	return nil
 
 }
 
 func (app *Application) InitDB() error {
 	app.PGPool = db.GetDB()
+	metrics.RegisterPool(app.PGPool)
 	return nil
 }
 
+// InitSchema - applies pending migrations if `migrations.auto` is set
+// and checks that measurements table matches columns emitted by writer
+func (app *Application) InitSchema() error {
+	migrator, err := migrations.GetMigrator()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if viper.GetBool("migrations.auto") {
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %v_%v", m.Version, m.Name)
+		}
+	}
+	if err := migrator.Verify(ctx, wb.MeasurementColumns); err != nil {
+		return err
+	}
+	app.Partitions, err = migrator.Partitions()
+	return err
+}
+
 func (app *Application) InitSever() error {
 	app.Server = server.NewServer()
 	return nil
 }
 
+// InitMQTT - creates MQTT subscriber feeding write buffer if it is enabled in config
+func (app *Application) InitMQTT() error {
+	if !viper.GetBool("mqtt.enabled") {
+		return nil
+	}
+	conf := mqtt.Config{}
+	if err := viper.UnmarshalKey("mqtt", &conf); err != nil {
+		return err
+	}
+	sub, err := mqtt.NewSubscriber(conf, app.WriteBuffer)
+	if err != nil {
+		return err
+	}
+	app.MQTT = sub
+	return nil
+}
+
 func (app *Application) Run() {
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
+	stop := make(chan struct{})
 	go func() {
 		<-c
 		fmt.Println("Gracefully shutting down...")
+		close(stop)
+		if app.MQTT != nil {
+			app.MQTT.Stop()
+		}
+		stream.GetHub().Close()
 		_ = app.Server.Shutdown()
 		app.WriteBuffer.Shutdown()
 	}()
 	go app.WriteBuffer.RunDataHandler()
+	if app.Partitions != nil {
+		go app.Partitions.Run(stop)
+	}
+	if app.MQTT != nil {
+		if err := app.MQTT.Start(); err != nil {
+			log.Panic(err)
+		}
+	}
 	host := viper.GetString("server.host")
 	port := viper.GetString("server.port")
 
@@ -78,6 +157,9 @@ func (app *Application) Run() {
 	}
 	// Final flush
 	app.WriteBuffer.FlushBuffer()
+	if err := app.WriteBuffer.Close(); err != nil {
+		log.Println(err)
+	}
 
 }
 
@@ -101,6 +183,10 @@ func (app *Application) Init() error {
 	if err != nil {
 		return err
 	}
+	err = app.InitSchema()
+	if err != nil {
+		return err
+	}
 	err = app.InitWriteBuffer()
 	if err != nil {
 		return err
@@ -110,5 +196,9 @@ func (app *Application) Init() error {
 	if err != nil {
 		return err
 	}
+	err = app.InitMQTT()
+	if err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,47 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: gmcollector [command]
+
+Without command collector server is started.
+
+Commands:
+  keys create -name NAME -scopes write,read [-devices ID,ID] [-group NAME] [-expires 720h]
+  keys list
+  keys rotate ID
+  keys revoke ID
+  migrate up
+  migrate down [-steps 1]
+  migrate status
+  migrate dedupe    move duplicate (device, timestamp) rows aside, required by unique index migration
+`
+
+// Run - executes administrative subcommand and returns process exit code
+func Run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "keys":
+		err = runKeys(args[1:])
+	case "migrate":
+		err = runMigrate(args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command `%v`\n\n%v", args[0], usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
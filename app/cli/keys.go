@@ -0,0 +1,119 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	cfg "github.com/qwlt/gmcollector/app/config"
+)
+
+var errUsage = errors.New("invalid arguments, see `gmcollector help`")
+
+func runKeys(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	if err := cfg.ReadConfig(); err != nil {
+		return err
+	}
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		name := fs.String("name", "", "key name")
+		scopes := fs.String("scopes", apikeys.ScopeWrite, "comma separated scopes: write, read, admin")
+		devices := fs.String("devices", "", "comma separated device ids the key is bound to")
+		group := fs.String("group", "", "device group the key is bound to")
+		expires := fs.Duration("expires", 0, "key lifetime, never expires if not set")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" {
+			return errUsage
+		}
+		var deviceIDs []uuid.UUID
+		for _, s := range splitList(*devices) {
+			id, err := uuid.Parse(s)
+			if err != nil {
+				return err
+			}
+			deviceIDs = append(deviceIDs, id)
+		}
+		var expiresAt *time.Time
+		if *expires > 0 {
+			t := time.Now().Add(*expires)
+			expiresAt = &t
+		}
+		var deviceGroup *string
+		if *group != "" {
+			deviceGroup = group
+		}
+		key, token, err := store.Create(ctx, *name, splitList(*scopes), deviceIDs, deviceGroup, expiresAt)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("id:    %v\ntoken: %v\n", key.ID, token)
+	case "list":
+		keys, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tDEVICES\tEXPIRES\tSTATE")
+		for _, k := range keys {
+			expires := "never"
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+			}
+			state := "active"
+			if k.RevokedAt != nil {
+				state = "revoked"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", k.ID, k.Name, strings.Join(k.Scopes, ","), len(k.DeviceIDs), expires, state)
+		}
+		return w.Flush()
+	case "rotate", "revoke":
+		if len(args) != 2 {
+			return errUsage
+		}
+		id, err := uuid.Parse(args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "revoke" {
+			return store.Revoke(ctx, id)
+		}
+		token, err := store.Rotate(ctx, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("token: %v\n", token)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	cfg "github.com/qwlt/gmcollector/app/config"
+	"github.com/qwlt/gmcollector/app/migrations"
+)
+
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	if err := cfg.ReadConfig(); err != nil {
+		return err
+	}
+	migrator, err := migrations.GetMigrator()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %v_%v\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		steps := fs.Int("steps", 1, "number of migrations to revert")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		reverted, err := migrator.Down(ctx, *steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %v_%v\n", m.Version, m.Name)
+		}
+		return err
+	case "dedupe":
+		moved, err := migrator.RemoveDuplicates(ctx)
+		if err == nil {
+			fmt.Printf("moved %v duplicate rows\n", moved)
+		}
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return errUsage
+	}
+}
@@ -0,0 +1,171 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qwlt/gmcollector/app/models"
+)
+
+const batchExt = ".json"
+
+var ErrBatchNotFound = errors.New("dead letter batch not found")
+
+// Config - dead letter store settings, read from `pool.deadLetter` section
+// Dir - directory where failed batches are saved as JSON files
+type Config struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Dir     string `mapstructure:"dir"`
+}
+
+// Batch - datapoints which could not be written to storage after all retries
+type Batch struct {
+	ID         string               `json:"id"`
+	CreatedAt  time.Time            `json:"createdAt"`
+	Attempts   int                  `json:"attempts"`
+	Error      string               `json:"error"`
+	Datapoints []models.Measurement `json:"datapoints"`
+}
+
+// Summary - batch description without datapoints, used for listing
+type Summary struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Count     int       `json:"count"`
+}
+
+// Store - directory of JSON encoded batches
+type Store struct {
+	mu  sync.Mutex
+	dir string
+	seq uint64
+}
+
+func Open(conf Config) (*Store, error) {
+	dir := conf.Dir
+	if dir == "" {
+		dir = "deadletter"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put - saves batch along with error which caused its rejection and returns batch id
+func (s *Store) Put(data []models.Model, attempts int, cause error) (string, error) {
+	s.mu.Lock()
+	s.seq++
+	now := time.Now().UTC()
+	id := fmt.Sprintf("%v-%06d", now.Format("20060102T150405.000000000"), s.seq)
+	s.mu.Unlock()
+
+	batch := Batch{ID: id, CreatedAt: now, Attempts: attempts, Datapoints: make([]models.Measurement, 0, len(data))}
+	if cause != nil {
+		batch.Error = cause.Error()
+	}
+	for i := range data {
+		v, ok := models.AsMeasurement(data[i])
+		if !ok {
+			return "", fmt.Errorf("dead letter: unsupported model type %T", data[i])
+		}
+		batch.Datapoints = append(batch.Datapoints, v)
+	}
+	return id, s.save(&batch)
+}
+
+// List - returns summaries of stored batches ordered by creation time
+func (s *Store) List() ([]Summary, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]Summary, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), batchExt) {
+			continue
+		}
+		batch, err := s.Load(strings.TrimSuffix(e.Name(), batchExt))
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, Summary{
+			ID:        batch.ID,
+			CreatedAt: batch.CreatedAt,
+			Attempts:  batch.Attempts,
+			Error:     batch.Error,
+			Count:     len(batch.Datapoints),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].ID < summaries[j].ID })
+	return summaries, nil
+}
+
+func (s *Store) Load(id string) (*Batch, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	batch := &Batch{}
+	if err := json.Unmarshal(raw, batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// Update - overwrites stored batch, used to keep datapoints which were not re-injected
+func (s *Store) Update(batch *Batch) error {
+	if _, err := s.path(batch.ID); err != nil {
+		return err
+	}
+	return s.save(batch)
+}
+
+func (s *Store) Remove(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrBatchNotFound
+	}
+	return err
+}
+
+// save - writes batch into temporary file first, so readers never see partial batch
+func (s *Store) save(batch *Batch) error {
+	raw, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, batch.ID+batchExt)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *Store) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+		return "", ErrBatchNotFound
+	}
+	return filepath.Join(s.dir, id+batchExt), nil
+}
@@ -0,0 +1,198 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+const namespace = "gmcollector"
+
+const (
+	SourceHTTP = "http"
+	SourceBulk = "bulk"
+	SourceMQTT = "mqtt"
+
+	ResultAccepted = "accepted"
+	ResultRejected = "rejected"
+)
+
+var (
+	Datapoints = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "datapoints_total",
+		Help:      "Number of received datapoints by ingestion source and result.",
+	}, []string{"source", "result"})
+
+	BufferLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_length",
+		Help:      "Number of datapoints collected in write buffer and not flushed yet.",
+	})
+
+	BufferTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_timeouts_total",
+		Help:      "Number of datapoints rejected because write buffer channel was full.",
+	})
+
+	BufferRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_rejections_total",
+		Help:      "Number of datapoints rejected by admission policy without waiting, by reason.",
+	}, []string{"reason"})
+
+	FlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "flush_duration_seconds",
+		Help:      "Duration of buffer flushes including retries.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	})
+
+	FlushErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "flush_errors_total",
+		Help:      "Number of flushes which failed all write attempts.",
+	})
+
+	FlushQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "flush_queue_depth",
+		Help:      "Number of batches waiting for flush workers.",
+	})
+
+	FlushInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "flush_in_flight",
+		Help:      "Number of batches being written by flush workers.",
+	})
+
+	WriteBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "write_batch_size",
+		Help:      "Number of datapoints in batches passed to storage writer.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 16),
+	})
+
+	DeadLetterBatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deadletter_batches_total",
+		Help:      "Number of batches moved to dead letter store.",
+	})
+
+	DuplicatesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicates_dropped_total",
+		Help:      "Number of datapoints dropped from batches as duplicates of (device, timestamp).",
+	})
+
+	RejectedRows = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_rows_total",
+		Help:      "Number of datapoints rejected by storage because of their content.",
+	})
+
+	RowCountMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "row_count_mismatches_total",
+		Help:      "Number of writes where affected rows differed from batch size.",
+	})
+
+	StreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_subscribers",
+		Help:      "Number of connected live stream subscribers.",
+	})
+
+	StreamDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_dropped_total",
+		Help:      "Number of live stream events dropped because subscriber queue was full.",
+	})
+)
+
+// ChannelReporter - source of write buffer channel occupancy
+type ChannelReporter interface {
+	ChannelLength() int
+	ChannelCapacity() int
+}
+
+var (
+	bufferOnce sync.Once
+	bufferMu   sync.RWMutex
+	buffer     ChannelReporter
+)
+
+// RegisterBuffer - exposes occupancy of write buffer channel, gauges are registered once
+// and report the buffer passed by the latest call, so buffer may be recreated
+func RegisterBuffer(b ChannelReporter) {
+	bufferMu.Lock()
+	buffer = b
+	bufferMu.Unlock()
+	bufferOnce.Do(func() {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "buffer_channel_length",
+			Help:      "Number of datapoints waiting in write buffer channel.",
+		}, func() float64 { return channelStat(ChannelReporter.ChannelLength) })
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "buffer_channel_capacity",
+			Help:      "Capacity of write buffer channel.",
+		}, func() float64 { return channelStat(ChannelReporter.ChannelCapacity) })
+	})
+}
+
+func channelStat(stat func(ChannelReporter) int) float64 {
+	bufferMu.RLock()
+	defer bufferMu.RUnlock()
+	if buffer == nil {
+		return 0
+	}
+	return float64(stat(buffer))
+}
+
+// RegisterPool - exposes connections statistics of postgres pool
+func RegisterPool(pool *pgxpool.Pool) {
+	prometheus.MustRegister(&poolCollector{pool: pool})
+}
+
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+var (
+	poolAcquiredDesc = prometheus.NewDesc(namespace+"_pgpool_acquired_conns", "Number of currently acquired connections.", nil, nil)
+	poolIdleDesc     = prometheus.NewDesc(namespace+"_pgpool_idle_conns", "Number of currently idle connections.", nil, nil)
+	poolTotalDesc    = prometheus.NewDesc(namespace+"_pgpool_total_conns", "Total number of connections in the pool.", nil, nil)
+	poolMaxDesc      = prometheus.NewDesc(namespace+"_pgpool_max_conns", "Max size of the pool.", nil, nil)
+)
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredDesc
+	ch <- poolIdleDesc
+	ch <- poolTotalDesc
+	ch <- poolMaxDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredDesc, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalDesc, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxDesc, prometheus.GaugeValue, float64(stat.MaxConns()))
+}
+
+// Handler - serves registered metrics in prometheus text format
+func Handler() fiber.Handler {
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		return nil
+	}
+}
@@ -0,0 +1,27 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+type channel struct{ length, capacity int }
+
+func (c channel) ChannelLength() int   { return c.length }
+func (c channel) ChannelCapacity() int { return c.capacity }
+
+func TestRegisterBufferTwice(t *testing.T) {
+	RegisterBuffer(channel{1, 10})
+	require.NotPanics(t, func() { RegisterBuffer(channel{2, 20}) })
+
+	expected := `
+# HELP gmcollector_buffer_channel_length Number of datapoints waiting in write buffer channel.
+# TYPE gmcollector_buffer_channel_length gauge
+gmcollector_buffer_channel_length 2
+`
+	require.NoError(t, testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "gmcollector_buffer_channel_length"))
+}
@@ -0,0 +1,396 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/qwlt/gmcollector/app/db"
+	"github.com/qwlt/gmcollector/app/partitions"
+	"github.com/spf13/viper"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockID - key of advisory lock held while migrating, so concurrently starting collectors don't race
+const lockID = 7351902
+
+const schema = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	table_name TEXT NOT NULL,
+	version INT NOT NULL,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (table_name, version)
+);`
+
+var (
+	fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	// writers use table name unquoted, so upper case letters would be folded by postgres
+	tableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*(\.[a-z_][a-z0-9_]*)?$`)
+)
+
+// Migration - versioned schema change of measurements table or of tables it's used with, like API keys
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status - migration and time it was applied at, nil if it is pending
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrator - applies embedded migrations to measurements table with given name,
+// applied versions are tracked per table in schema_migrations
+type Migrator struct {
+	pool       *pgxpool.Pool
+	table      string
+	migrations []Migration
+	Storage    StorageConfig
+}
+
+// params - values available inside migration templates
+type params struct {
+	table pgx.Identifier
+}
+
+func (p params) Table() string {
+	return p.table.Sanitize()
+}
+
+func newParams(table string) params {
+	return params{table: pgx.Identifier(strings.Split(table, "."))}
+}
+
+func (m *Migrator) params() params {
+	return newParams(m.table)
+}
+
+// Index - name of table index, indexes live in schema of their table so name is not qualified
+func (p params) Index(suffix string) string {
+	return pgx.Identifier{p.table[len(p.table)-1] + "_" + suffix}.Sanitize()
+}
+
+// QualifiedIndex - name of table index qualified with schema of table
+func (p params) QualifiedIndex(suffix string) string {
+	return p.Sibling(suffix)
+}
+
+// Sibling - name of relation named after table with suffix, qualified with schema of table
+func (p params) Sibling(suffix string) string {
+	id := append(pgx.Identifier{}, p.table[:len(p.table)-1]...)
+	return append(id, p.table[len(p.table)-1]+"_"+suffix).Sanitize()
+}
+
+func New(pool *pgxpool.Pool, table string) (*Migrator, error) {
+	migrations, err := Load(table)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, table: table, migrations: migrations}, nil
+}
+
+// Load - renders embedded migrations for table ordered by version
+func Load(table string) ([]Migration, error) {
+	if !tableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name `%v`", table)
+	}
+	p := newParams(table)
+	entries, err := files.ReadDir("sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		parts := fileName.FindStringSubmatch(e.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("invalid migration file name `%v`", e.Name())
+		}
+		version, _ := strconv.Atoi(parts[1])
+		raw, err := files.ReadFile(path.Join("sql", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(e.Name()).Parse(string(raw))
+		if err != nil {
+			return nil, err
+		}
+		var sql bytes.Buffer
+		if err := tmpl.Execute(&sql, p); err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		}
+		if parts[3] == "up" {
+			m.Up = sql.String()
+		} else {
+			m.Down = sql.String()
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %v must have both up and down files", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withLock - runs fn on single connection holding migration lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", lockID); err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+	if _, err := conn.Exec(ctx, schema); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT version, applied_at FROM schema_migrations WHERE table_name = $1", m.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Up - applies pending migrations in order, each one in its own transaction,
+// then applies TimescaleDB settings if they are enabled, table stays plain if extension is missing
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	done := make([]Migration, 0)
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err := m.apply(ctx, conn, mig.Up,
+				"INSERT INTO schema_migrations (table_name, version, name) VALUES ($1, $2, $3)", m.table, mig.Version, mig.Name)
+			if err != nil {
+				return fmt.Errorf("migration %v_%v failed: %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig)
+		}
+		if m.Storage.Timescale.Enabled && m.Storage.Partitioning.Enabled {
+			return errors.New("timescale and partitioning storage modes can't be enabled together")
+		}
+		if m.Storage.Partitioning.Enabled {
+			return m.applyPartitioning(ctx, conn)
+		}
+		err = m.applyTimescale(ctx, conn)
+		if err == ErrTimescaleUnavailable {
+			log.Printf("TimescaleDB mode is enabled, but %v, table `%v` is kept as plain table", err, m.table)
+			return nil
+		}
+		return err
+	})
+	return done, err
+}
+
+// Partitions - returns partition manager of table or nil if partitioning is disabled
+func (m *Migrator) Partitions() (*partitions.Manager, error) {
+	if !m.Storage.Partitioning.Enabled {
+		return nil, nil
+	}
+	return partitions.New(m.pool, m.table, m.Storage.Partitioning)
+}
+
+// applyPartitioning - converts table into partitioned one and creates partitions ahead
+func (m *Migrator) applyPartitioning(ctx context.Context, conn *pgxpool.Conn) error {
+	manager, err := m.Partitions()
+	if err != nil {
+		return err
+	}
+	if err := manager.EnsurePartitioned(ctx, conn); err != nil {
+		return err
+	}
+	return manager.Maintain(ctx, time.Now())
+}
+
+// Down - reverts given number of most recent applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	done := make([]Migration, 0)
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			err := m.apply(ctx, conn, mig.Down,
+				"DELETE FROM schema_migrations WHERE table_name = $1 AND version = $2", m.table, mig.Version)
+			if err != nil {
+				return fmt.Errorf("revert of migration %v_%v failed: %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *pgxpool.Conn, sql string, record string, args ...interface{}) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RemoveDuplicates - moves all rows but one of every (uid, datetime) into <table>_duplicates,
+// so unique index can be created; which row stays is arbitrary, moved rows can be reviewed
+// and restored from that table; returns number of moved rows
+func (m *Migrator) RemoveDuplicates(ctx context.Context) (int64, error) {
+	var moved int64
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		p := m.params()
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(context.Background())
+		if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %v (LIKE %v)", p.Sibling("duplicates"), p.Table())); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, fmt.Sprintf(`WITH moved AS (DELETE FROM %[1]v a USING %[1]v b
+WHERE a.uid = b.uid AND a.datetime = b.datetime AND a.ctid > b.ctid RETURNING a.*)
+INSERT INTO %[2]v SELECT * FROM moved`, p.Table(), p.Sibling("duplicates")))
+		if err != nil {
+			return err
+		}
+		moved = tag.RowsAffected()
+		return tx.Commit(ctx)
+	})
+	if err == nil {
+		log.Printf("Moved %v duplicate rows of `%v` to `%v_duplicates`", moved, m.table, m.table)
+	}
+	return moved, err
+}
+
+// Status - returns every known migration with time it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			s := Status{Migration: mig}
+			if at, ok := applied[mig.Version]; ok {
+				s.AppliedAt = &at
+			}
+			statuses = append(statuses, s)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Verify - checks that table has every column writer emits
+func (m *Migrator) Verify(ctx context.Context, columns []string) error {
+	schemaName, table := "", m.table
+	if i := strings.Index(m.table, "."); i >= 0 {
+		schemaName, table = m.table[:i], m.table[i+1:]
+	}
+	rows, err := m.pool.Query(ctx, `SELECT column_name FROM information_schema.columns
+WHERE table_name = $1 AND table_schema = COALESCE(NULLIF($2, ''), current_schema())`, table, schemaName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("table `%v` does not exist, run `gmcollector migrate up`", m.table)
+	}
+	var missing []string
+	for _, c := range columns {
+		if !existing[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("table `%v` has no columns %v written by collector", m.table, missing)
+	}
+	return nil
+}
+
+// GetMigrator - returns migrator of table configured in `pool.tableName`
+func GetMigrator() (*Migrator, error) {
+	table := viper.GetString("pool.tableName")
+	if table == "" {
+		table = "measurements"
+	}
+	m, err := New(db.GetDB(), table)
+	if err != nil {
+		return nil, err
+	}
+	if viper.IsSet("storage") {
+		if err := viper.UnmarshalKey("storage", &m.Storage); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
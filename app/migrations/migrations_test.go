@@ -0,0 +1,71 @@
+package migrations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRendersTableName(t *testing.T) {
+	migrations, err := Load("telemetry.readings")
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	require.Equal(t, 1, migrations[0].Version)
+	require.Equal(t, "create_measurements", migrations[0].Name)
+	require.Contains(t, migrations[0].Up, `CREATE TABLE IF NOT EXISTS "telemetry"."readings"`)
+	require.Contains(t, migrations[0].Up, `"readings_uid_datetime_idx" ON "telemetry"."readings"`)
+	require.Contains(t, migrations[0].Down, `DROP TABLE IF EXISTS "telemetry"."readings"`)
+	require.Contains(t, migrations[1].Up, `DROP INDEX IF EXISTS "telemetry"."readings_uid_datetime_idx"`)
+	require.Contains(t, migrations[1].Up, `"telemetry"."readings_duplicates"`)
+	require.NotContains(t, migrations[1].Up, "DELETE")
+	require.Equal(t, "create_api_keys", migrations[2].Name)
+	require.Contains(t, migrations[2].Up, "CREATE TABLE IF NOT EXISTS api_keys")
+	for i := 1; i < len(migrations); i++ {
+		require.Less(t, migrations[i-1].Version, migrations[i].Version)
+	}
+}
+
+func TestLoadRejectsInvalidTableName(t *testing.T) {
+	for _, name := range []string{"", "measurements; DROP TABLE x", "a.b.c", "1table", "Measurements"} {
+		_, err := Load(name)
+		require.Error(t, err, name)
+	}
+}
+
+func TestTimescaleStatements(t *testing.T) {
+	day := 24 * time.Hour
+	conf := TimescaleConfig{Enabled: true, ChunkInterval: day, CompressAfter: 7 * day, Retention: 90 * day}
+	current := hypertableState{hypertable: true, compressed: true, chunkInterval: day, compressAfter: 7 * day, retention: 90 * day}
+	tests := []struct {
+		name  string
+		conf  TimescaleConfig
+		state hypertableState
+		want  []string
+	}{
+		{"plain table", conf, hypertableState{},
+			[]string{"create_hypertable", "timescaledb.compress,", "add_compression_policy", "add_retention_policy"}},
+		{"plain table without policies", TimescaleConfig{Enabled: true, ChunkInterval: day}, hypertableState{},
+			[]string{"create_hypertable"}},
+		{"up to date", conf, current, nil},
+		{"chunk interval changed", TimescaleConfig{Enabled: true, ChunkInterval: 12 * time.Hour, CompressAfter: 7 * day, Retention: 90 * day}, current,
+			[]string{"set_chunk_time_interval"}},
+		{"compression changed", TimescaleConfig{Enabled: true, ChunkInterval: day, CompressAfter: 3 * day, Retention: 90 * day}, current,
+			[]string{"remove_compression_policy", "add_compression_policy"}},
+		{"compression enabled", conf, hypertableState{hypertable: true, chunkInterval: day, retention: 90 * day},
+			[]string{"timescaledb.compress,", "add_compression_policy"}},
+		{"retention changed", TimescaleConfig{Enabled: true, ChunkInterval: day, CompressAfter: 7 * day, Retention: 30 * day}, current,
+			[]string{"remove_retention_policy", "add_retention_policy"}},
+		{"policies disabled", TimescaleConfig{Enabled: true, ChunkInterval: day}, current,
+			[]string{"remove_compression_policy", "remove_retention_policy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements := timescaleStatements(`"public"."measurements"`, tt.conf, tt.state)
+			require.Len(t, statements, len(tt.want))
+			for i := range tt.want {
+				require.Contains(t, statements[i].sql, tt.want[i])
+			}
+		})
+	}
+}
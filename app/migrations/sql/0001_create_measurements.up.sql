@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS {{.Table}} (
+	uid UUID NOT NULL,
+	datetime TIMESTAMPTZ NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	metadata JSONB
+);
+CREATE INDEX IF NOT EXISTS {{.Index "uid_datetime_idx"}} ON {{.Table}} (uid, datetime);
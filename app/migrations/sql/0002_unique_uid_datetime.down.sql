@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS {{.Index "uid_datetime_idx"}} ON {{.Table}} (uid, datetime);
+DROP INDEX IF EXISTS {{.QualifiedIndex "uid_datetime_key"}};
@@ -0,0 +1,11 @@
+-- ON CONFLICT needs unique index, duplicates stored before are not removed silently,
+-- operator decides which rows to keep or runs `migrate dedupe`
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM {{.Table}} GROUP BY uid, datetime HAVING count(*) > 1) THEN
+		RAISE EXCEPTION 'table {{.Table}} has several rows with the same (uid, datetime)'
+			USING HINT = 'run `gmcollector migrate dedupe` to move extra rows to {{.Sibling "duplicates"}} or remove them manually, then migrate again';
+	END IF;
+END $$;
+CREATE UNIQUE INDEX IF NOT EXISTS {{.Index "uid_datetime_key"}} ON {{.Table}} (uid, datetime);
+DROP INDEX IF EXISTS {{.QualifiedIndex "uid_datetime_idx"}};
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS device_groups;
+DROP TABLE IF EXISTS api_keys;
@@ -0,0 +1,19 @@
+-- API keys are shared by every measurements table, so tables are created only once;
+-- tables created on start by previous versions already have every column
+CREATE TABLE IF NOT EXISTS api_keys (
+	id UUID PRIMARY KEY,
+	name TEXT NOT NULL,
+	secret_hash BYTEA NOT NULL,
+	scopes TEXT[] NOT NULL DEFAULT '{}',
+	device_ids UUID[] NOT NULL DEFAULT '{}',
+	device_group TEXT,
+	expires_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	rotated_at TIMESTAMPTZ
+);
+CREATE TABLE IF NOT EXISTS device_groups (
+	group_name TEXT NOT NULL,
+	uid UUID NOT NULL,
+	PRIMARY KEY (group_name, uid)
+);
@@ -0,0 +1,162 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/qwlt/gmcollector/app/partitions"
+)
+
+var ErrTimescaleUnavailable = errors.New("timescaledb extension is not available")
+
+// StorageConfig - optional storage features, read from `storage` section,
+// TimescaleDB and native partitioning are mutually exclusive
+type StorageConfig struct {
+	Timescale    TimescaleConfig   `mapstructure:"timescale"`
+	Partitioning partitions.Config `mapstructure:"partitioning"`
+}
+
+// TimescaleConfig - hypertable settings applied after migrations
+// Enabled - convert measurements table into hypertable partitioned by datetime
+// ChunkInterval - time range of a single chunk, applies to newly created chunks only
+// CompressAfter - compress chunks older than this, segmented by uid; disabled if zero
+// Retention - drop chunks older than this; disabled if zero
+type TimescaleConfig struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	ChunkInterval time.Duration `mapstructure:"chunkInterval"`
+	CompressAfter time.Duration `mapstructure:"compressAfter"`
+	Retention     time.Duration `mapstructure:"retention"`
+}
+
+// timescaleAvailable - checks whether extension is installed on server and can be created
+func (m *Migrator) timescaleAvailable(ctx context.Context, conn *pgxpool.Conn) (bool, error) {
+	var available bool
+	err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'timescaledb')").Scan(&available)
+	if err != nil || !available {
+		return false, err
+	}
+	// extension needs to be preloaded by server, creating it fails otherwise
+	if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		log.Printf("Cant create timescaledb extension: %v", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// applyTimescale - converts table into hypertable and brings its chunk interval,
+// compression and retention policies to configured state, safe to run repeatedly;
+// policies matching configuration are kept, so their job schedules are not reset
+func (m *Migrator) applyTimescale(ctx context.Context, conn *pgxpool.Conn) error {
+	conf := m.Storage.Timescale
+	if !conf.Enabled {
+		return nil
+	}
+	ok, err := m.timescaleAvailable(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTimescaleUnavailable
+	}
+	if conf.ChunkInterval <= 0 {
+		conf.ChunkInterval = 24 * time.Hour
+	}
+
+	state, err := m.hypertableState(ctx, conn)
+	if err != nil {
+		return err
+	}
+	statements := timescaleStatements(m.params().Table(), conf, state)
+	if len(statements) == 0 {
+		return nil
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	for _, s := range statements {
+		if _, err := tx.Exec(ctx, s.sql, s.args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+type statement struct {
+	sql  string
+	args []interface{}
+}
+
+// hypertableState - current TimescaleDB settings of table, zero policy interval means no policy
+type hypertableState struct {
+	hypertable    bool
+	compressed    bool
+	chunkInterval time.Duration
+	compressAfter time.Duration
+	retention     time.Duration
+}
+
+// timescaleStatements - statements bringing table from state to configured one
+func timescaleStatements(table string, conf TimescaleConfig, state hypertableState) []statement {
+	statements := make([]statement, 0)
+	if !state.hypertable {
+		statements = append(statements, statement{
+			"SELECT create_hypertable($1::regclass, 'datetime', chunk_time_interval => $2::interval, if_not_exists => TRUE, migrate_data => TRUE)",
+			[]interface{}{table, conf.ChunkInterval}})
+	} else if state.chunkInterval != conf.ChunkInterval {
+		statements = append(statements, statement{"SELECT set_chunk_time_interval($1::regclass, $2::interval)", []interface{}{table, conf.ChunkInterval}})
+	}
+	// compression settings can't be changed once chunks are compressed
+	if conf.CompressAfter > 0 && !state.compressed {
+		statements = append(statements, statement{
+			"ALTER TABLE " + table + " SET (timescaledb.compress, timescaledb.compress_segmentby = 'uid', timescaledb.compress_orderby = 'datetime DESC')", nil})
+	}
+	if state.compressAfter != conf.CompressAfter {
+		if state.compressAfter > 0 {
+			statements = append(statements, statement{"SELECT remove_compression_policy($1::regclass, if_exists => TRUE)", []interface{}{table}})
+		}
+		if conf.CompressAfter > 0 {
+			statements = append(statements, statement{"SELECT add_compression_policy($1::regclass, $2::interval)", []interface{}{table, conf.CompressAfter}})
+		}
+	}
+	if state.retention != conf.Retention {
+		if state.retention > 0 {
+			statements = append(statements, statement{"SELECT remove_retention_policy($1::regclass, if_exists => TRUE)", []interface{}{table}})
+		}
+		if conf.Retention > 0 {
+			statements = append(statements, statement{"SELECT add_retention_policy($1::regclass, $2::interval)", []interface{}{table, conf.Retention}})
+		}
+	}
+	return statements
+}
+
+// hypertableState - reads settings of table from timescaledb_information views,
+// intervals are compared in seconds
+func (m *Migrator) hypertableState(ctx context.Context, conn *pgxpool.Conn) (hypertableState, error) {
+	var state hypertableState
+	var chunk, compress, retention float64
+	err := conn.QueryRow(ctx, `WITH h AS (SELECT * FROM timescaledb_information.hypertables
+	WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass)
+SELECT EXISTS (SELECT 1 FROM h),
+	COALESCE((SELECT compression_enabled FROM h), FALSE),
+	COALESCE((SELECT extract(epoch FROM d.time_interval)::float8 FROM timescaledb_information.dimensions d JOIN h USING (hypertable_schema, hypertable_name)
+		WHERE d.column_name = 'datetime'), 0),
+	COALESCE((SELECT extract(epoch FROM (j.config->>'compress_after')::interval)::float8 FROM timescaledb_information.jobs j JOIN h USING (hypertable_schema, hypertable_name)
+		WHERE j.proc_name = 'policy_compression'), 0),
+	COALESCE((SELECT extract(epoch FROM (j.config->>'drop_after')::interval)::float8 FROM timescaledb_information.jobs j JOIN h USING (hypertable_schema, hypertable_name)
+		WHERE j.proc_name = 'policy_retention'), 0)`,
+		m.params().Table()).Scan(&state.hypertable, &state.compressed, &chunk, &compress, &retention)
+	state.chunkInterval = secondsDuration(chunk)
+	state.compressAfter = secondsDuration(compress)
+	state.retention = secondsDuration(retention)
+	return state, err
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(math.Round(seconds)) * time.Second
+}
@@ -20,6 +20,18 @@ type Measurement struct {
 
 func (m Measurement) Flatten() []interface{} {
 	fields := make([]interface{}, 0, 8)
-	fields = append(fields, m.DeviceID, m.Timestamp, m.Value)
+	fields = append(fields, m.DeviceID, m.Timestamp, m.Value, m.Metadata)
 	return fields
 }
+
+// AsMeasurement - returns datapoint as Measurement value if it holds one
+func AsMeasurement(datapoint Model) (Measurement, bool) {
+	switch v := datapoint.(type) {
+	case Measurement:
+		return v, true
+	case *Measurement:
+		return *v, true
+	default:
+		return Measurement{}, false
+	}
+}
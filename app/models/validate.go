@@ -0,0 +1,84 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+)
+
+var validate *validator.Validate
+
+// MeasurementValidator - measurement as received by transports, validated with the same
+// rules by HTTP and MQTT
+type MeasurementValidator struct {
+	DeviceID  uuid.UUID              `json:"id" validate:"required"`
+	Value     float64                `json:"value" validate:"required"`
+	Timestamp time.Time              `json:"timestamp" validate:"required"`
+	Metadata  map[string]interface{} `json:"metadata" validate:"metadata_keys,metadata_size"`
+}
+
+func (mv *MeasurementValidator) Measurement() Measurement {
+	return Measurement{DeviceID: mv.DeviceID, Value: mv.Value, Timestamp: mv.Timestamp, Metadata: mv.Metadata}
+}
+
+// MetadataLimits - restrictions applied to `metadata` object of a measurement
+// MaxKeys - max number of top level keys
+// MaxBytes - max size of JSON encoded object
+type MetadataLimits struct {
+	MaxKeys  int `mapstructure:"maxKeys"`
+	MaxBytes int `mapstructure:"maxBytes"`
+}
+
+// InitValidator - must be called before measurements are validated
+func InitValidator(limits MetadataLimits) {
+	validate = validator.New()
+	registerMetadataValidators(validate, limits)
+}
+
+// ValidateMeasurement - returns map of field validation errors or nil if measurement is valid
+func ValidateMeasurement(mv *MeasurementValidator) map[string]interface{} {
+	err := validate.Struct(mv)
+	if err == nil {
+		return nil
+	}
+	errors := make(map[string]interface{})
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		errors["body"] = err.Error()
+		return errors
+	}
+	for _, err := range validationErrors {
+		errors[err.Field()] = fmt.Sprintf("Validation error: %v", err.Tag())
+	}
+	return errors
+}
+
+// ValidateStruct - validates struct by its `validate` tags with the same validator instance
+func ValidateStruct(v interface{}) error {
+	return validate.Struct(v)
+}
+
+func registerMetadataValidators(v *validator.Validate, limits MetadataLimits) {
+	v.RegisterValidation("metadata_keys", func(fl validator.FieldLevel) bool {
+		field := fl.Field()
+		if limits.MaxKeys <= 0 || field.Kind() != reflect.Map {
+			return true
+		}
+		return field.Len() <= limits.MaxKeys
+	})
+	v.RegisterValidation("metadata_size", func(fl validator.FieldLevel) bool {
+		field := fl.Field()
+		if limits.MaxBytes <= 0 || field.Kind() != reflect.Map || field.IsNil() {
+			return true
+		}
+		encoded, err := json.Marshal(field.Interface())
+		if err != nil {
+			return false
+		}
+		return len(encoded) <= limits.MaxBytes
+	})
+}
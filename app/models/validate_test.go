@@ -0,0 +1,43 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataValidators(t *testing.T) {
+	InitValidator(MetadataLimits{MaxKeys: 2, MaxBytes: 16})
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+		errors   []string
+	}{
+		{"nil", nil, nil},
+		{"empty", map[string]interface{}{}, nil},
+		{"max keys", map[string]interface{}{"a": 1, "b": 2}, nil},
+		{"too many keys", map[string]interface{}{"a": 1, "b": 2, "c": 3}, []string{"Metadata"}},
+		// {"fw":"1.0.234"} is 16 bytes
+		{"max size", map[string]interface{}{"fw": "1.0.234"}, nil},
+		{"too large", map[string]interface{}{"fw": "1.0.2345"}, []string{"Metadata"}},
+		{"unencodable", map[string]interface{}{"f": func() {}}, []string{"Metadata"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mv := MeasurementValidator{DeviceID: uuid.New(), Value: 1, Timestamp: time.Now(), Metadata: tt.metadata}
+			errors := ValidateMeasurement(&mv)
+			require.Len(t, errors, len(tt.errors))
+			for _, field := range tt.errors {
+				require.Contains(t, errors, field)
+			}
+		})
+	}
+
+	InitValidator(MetadataLimits{})
+	mv := MeasurementValidator{DeviceID: uuid.New(), Value: 1, Timestamp: time.Now(),
+		Metadata: map[string]interface{}{"a": 1, "b": 2, "c": strings.Repeat("x", 64)}}
+	require.Nil(t, ValidateMeasurement(&mv), "zero limits disable checks")
+}
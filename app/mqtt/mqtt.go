@@ -0,0 +1,264 @@
+package mqtt
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/metrics"
+	"github.com/qwlt/gmcollector/app/models"
+)
+
+var ErrNoDeviceID = errors.New("device id is absent in payload and topic")
+
+// Config - MQTT subscriber settings, read from `mqtt` section
+// BrokerURL - broker address like tcp://localhost:1883 or ssl://broker:8883
+// Topics - topic filters to subscribe, device id is taken from the first `+` wildcard
+// when payload doesn't contain it
+type Config struct {
+	Enabled        bool          `mapstructure:"enabled"`
+	BrokerURL      string        `mapstructure:"brokerURL"`
+	ClientID       string        `mapstructure:"clientID"`
+	Username       string        `mapstructure:"username"`
+	Password       string        `mapstructure:"password"`
+	QoS            byte          `mapstructure:"qos"`
+	Topics         []string      `mapstructure:"topics"`
+	ConnectTimeout time.Duration `mapstructure:"connectTimeout"`
+	TLS            TLSConfig     `mapstructure:"tls"`
+}
+
+type TLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"caFile"`
+	CertFile           string `mapstructure:"certFile"`
+	KeyFile            string `mapstructure:"keyFile"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+// DatapointAdder - destination of decoded measurements, usually write buffer
+type DatapointAdder interface {
+	AddDatapoint(datapoint models.Model) error
+}
+
+// Subscriber - consumes measurements published to MQTT broker
+type Subscriber struct {
+	conf   Config
+	client paho.Client
+	buffer DatapointAdder
+}
+
+func NewSubscriber(conf Config, buffer DatapointAdder) (*Subscriber, error) {
+	if conf.BrokerURL == "" {
+		return nil, errors.New("mqtt: brokerURL is not set")
+	}
+	if len(conf.Topics) == 0 {
+		return nil, errors.New("mqtt: no topics to subscribe")
+	}
+	if conf.QoS > 2 {
+		return nil, fmt.Errorf("mqtt: invalid qos %v", conf.QoS)
+	}
+	if conf.ClientID == "" {
+		conf.ClientID = "gmcollector-" + uuid.NewString()[:8]
+	}
+	if conf.ConnectTimeout <= 0 {
+		conf.ConnectTimeout = 10 * time.Second
+	}
+	s := &Subscriber{conf: conf, buffer: buffer}
+
+	opts := paho.NewClientOptions().
+		AddBroker(conf.BrokerURL).
+		SetClientID(conf.ClientID).
+		SetUsername(conf.Username).
+		SetPassword(conf.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(conf.ConnectTimeout).
+		SetOnConnectHandler(s.subscribe).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("mqtt: connection lost: %v", err)
+		})
+	if conf.TLS.Enabled {
+		tlsConf, err := newTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConf)
+	}
+	s.client = paho.NewClient(opts)
+	return s, nil
+}
+
+// Start - connects to broker, subscriptions are (re)established on every connect
+func (s *Subscriber) Start() error {
+	token := s.client.Connect()
+	if !token.WaitTimeout(s.conf.ConnectTimeout) {
+		return fmt.Errorf("mqtt: connection to %v timed out", s.conf.BrokerURL)
+	}
+	return token.Error()
+}
+
+func (s *Subscriber) Stop() {
+	s.client.Disconnect(250)
+}
+
+func (s *Subscriber) subscribe(client paho.Client) {
+	filters := make(map[string]byte, len(s.conf.Topics))
+	for _, topic := range s.conf.Topics {
+		filters[topic] = s.conf.QoS
+	}
+	token := client.SubscribeMultiple(filters, s.handleMessage)
+	if token.WaitTimeout(s.conf.ConnectTimeout) && token.Error() == nil {
+		log.Printf("mqtt: subscribed to %v", strings.Join(s.conf.Topics, ", "))
+		return
+	}
+	log.Printf("mqtt: subscription failed: %v", token.Error())
+}
+
+// handleMessage - message is acknowledged once its datapoints are handed to buffer (and logged
+// to WAL if it's enabled), invalid ones are acknowledged too, since redelivery won't fix them
+func (s *Subscriber) handleMessage(_ paho.Client, msg paho.Message) {
+	defer msg.Ack()
+	measurements, rejected, err := DecodePayload(s.conf.Topics, msg.Topic(), msg.Payload())
+	if err != nil {
+		metrics.Datapoints.WithLabelValues(metrics.SourceMQTT, metrics.ResultRejected).Inc()
+		log.Printf("mqtt: rejected message on %v: %v", msg.Topic(), err)
+		return
+	}
+	for _, err := range rejected {
+		metrics.Datapoints.WithLabelValues(metrics.SourceMQTT, metrics.ResultRejected).Inc()
+		log.Printf("mqtt: rejected measurement from %v: %v", msg.Topic(), err)
+	}
+	for i := range measurements {
+		if err := s.buffer.AddDatapoint(measurements[i]); err != nil {
+			metrics.Datapoints.WithLabelValues(metrics.SourceMQTT, metrics.ResultRejected).Inc()
+			log.Printf("mqtt: dropped measurement from %v: %v", msg.Topic(), err)
+			continue
+		}
+		metrics.Datapoints.WithLabelValues(metrics.SourceMQTT, metrics.ResultAccepted).Inc()
+	}
+}
+
+// ItemError - invalid item of array payload, other items of the message are still accepted
+type ItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item %v: %v", e.Index, e.Err)
+}
+
+// DecodePayload - decodes single measurement or array of measurements and validates them
+// with the same rules as HTTP endpoints, device id is taken from topic if absent in payload;
+// invalid items of array are returned separately, error means the whole message is rejected
+func DecodePayload(filters []string, topic string, payload []byte) ([]models.Measurement, []*ItemError, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		m, err := decodeItem(filters, topic, trimmed)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []models.Measurement{m}, nil, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(trimmed, &items); err != nil {
+		return nil, nil, err
+	}
+	measurements := make([]models.Measurement, 0, len(items))
+	var rejected []*ItemError
+	for i := range items {
+		m, err := decodeItem(filters, topic, items[i])
+		if err != nil {
+			rejected = append(rejected, &ItemError{Index: i, Err: err})
+			continue
+		}
+		measurements = append(measurements, m)
+	}
+	return measurements, rejected, nil
+}
+
+func decodeItem(filters []string, topic string, raw []byte) (models.Measurement, error) {
+	mv := models.MeasurementValidator{}
+	if err := json.Unmarshal(raw, &mv); err != nil {
+		return models.Measurement{}, err
+	}
+	if mv.DeviceID == uuid.Nil {
+		id, err := DeviceIDFromTopic(filters, topic)
+		if err != nil {
+			return models.Measurement{}, err
+		}
+		mv.DeviceID = id
+	}
+	if errors := models.ValidateMeasurement(&mv); errors != nil {
+		return models.Measurement{}, fmt.Errorf("validation failed: %v", errors)
+	}
+	return mv.Measurement(), nil
+}
+
+// DeviceIDFromTopic - returns topic level matched by the first `+` wildcard of the matching filter
+func DeviceIDFromTopic(filters []string, topic string) (uuid.UUID, error) {
+	levels := strings.Split(topic, "/")
+	for _, filter := range filters {
+		position, ok := matchFilter(strings.Split(filter, "/"), levels)
+		if !ok || position < 0 {
+			continue
+		}
+		return uuid.Parse(levels[position])
+	}
+	return uuid.Nil, ErrNoDeviceID
+}
+
+// matchFilter - checks topic against filter and returns position of the first `+` wildcard
+func matchFilter(filter, topic []string) (int, bool) {
+	position := -1
+	for i, level := range filter {
+		if level == "#" {
+			return position, true
+		}
+		if i >= len(topic) {
+			return -1, false
+		}
+		if level == "+" {
+			if position < 0 {
+				position = i
+			}
+			continue
+		}
+		if level != topic[i] {
+			return -1, false
+		}
+	}
+	return position, len(filter) == len(topic)
+}
+
+func newTLSConfig(conf TLSConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CAFile != "" {
+		ca, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("mqtt: no certificates found in %v", conf.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
@@ -0,0 +1,161 @@
+package mqtt
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/models"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+	"github.com/stretchr/testify/require"
+)
+
+var filters = []string{"devices/+/measurements", "gateways/+/devices/+/data"}
+
+func TestMain(m *testing.M) {
+	models.InitValidator(models.MetadataLimits{MaxKeys: 4})
+	os.Exit(m.Run())
+}
+
+func TestDeviceIDFromTopic(t *testing.T) {
+	id := uuid.New()
+	got, err := DeviceIDFromTopic(filters, "devices/"+id.String()+"/measurements")
+	require.NoError(t, err)
+	require.Equal(t, id, got)
+
+	_, err = DeviceIDFromTopic(filters, "devices/"+id.String()+"/status")
+	require.Equal(t, ErrNoDeviceID, err)
+
+	_, err = DeviceIDFromTopic(filters, "devices/not-uuid/measurements")
+	require.Error(t, err)
+}
+
+func TestDecodePayload(t *testing.T) {
+	id := uuid.New()
+	topic := "devices/" + id.String() + "/measurements"
+
+	m, rejected, err := DecodePayload(filters, topic, []byte(`{"value":3.3,"timestamp":"2021-11-01T10:00:00Z"}`))
+	require.NoError(t, err)
+	require.Empty(t, rejected)
+	require.Len(t, m, 1)
+	require.Equal(t, id, m[0].DeviceID)
+
+	other := uuid.New()
+	m, rejected, err = DecodePayload(filters, topic, []byte(`[{"id":"`+other.String()+`","value":1,"timestamp":"2021-11-01T10:00:00Z"},{"value":2,"timestamp":"2021-11-01T10:00:01Z"}]`))
+	require.NoError(t, err)
+	require.Empty(t, rejected)
+	require.Equal(t, other, m[0].DeviceID)
+	require.Equal(t, id, m[1].DeviceID)
+
+	// invalid items are reported, the rest of array is accepted
+	m, rejected, err = DecodePayload(filters, topic, []byte(`[{"timestamp":"2021-11-01T10:00:00Z"},{"value":2,"timestamp":"2021-11-01T10:00:01Z"},{"value":"x"}]`))
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	require.Equal(t, 2.0, m[0].Value)
+	require.Len(t, rejected, 2)
+	require.Equal(t, 0, rejected[0].Index)
+	require.Equal(t, 2, rejected[1].Index)
+
+	_, _, err = DecodePayload(filters, topic, []byte(`{"timestamp":"2021-11-01T10:00:00Z"}`))
+	require.Error(t, err)
+	_, _, err = DecodePayload(filters, topic, []byte(`not json`))
+	require.Error(t, err)
+	_, _, err = DecodePayload(filters, topic, []byte(`[{"value":1},`))
+	require.Error(t, err)
+}
+
+type collector struct {
+	mu   sync.Mutex
+	data []models.Model
+}
+
+func (c *collector) AddDatapoint(datapoint models.Model) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = append(c.data, datapoint)
+	return nil
+}
+
+func (c *collector) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.data)
+}
+
+// fakeMessage - received message, records acknowledgement and what buffer held at that moment
+type fakeMessage struct {
+	topic    string
+	payload  string
+	acked    bool
+	buffered int
+	buffer   *buff.WriteBuffer
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return m.topic }
+func (m *fakeMessage) MessageID() uint16 { return 1 }
+func (m *fakeMessage) Payload() []byte   { return []byte(m.payload) }
+func (m *fakeMessage) Ack() {
+	m.acked = true
+	m.buffered = m.buffer.ChannelLength()
+}
+
+func TestHandleMessage(t *testing.T) {
+	storage := &buff.RecordingStorage{}
+	buffer := buff.NewWriteBuffer(&buff.WBufferConfig{BufMaxSize: 10, WriteTimeout: 10}, storage)
+	sub := &Subscriber{conf: Config{Topics: filters}, buffer: buffer}
+	id := uuid.New()
+	topic := "devices/" + id.String() + "/measurements"
+
+	msg := &fakeMessage{topic: topic, buffer: buffer,
+		payload: `[{"value":1,"timestamp":"2021-11-01T10:00:00Z"},{"timestamp":"2021-11-01T10:00:01Z"},{"value":3,"timestamp":"2021-11-01T10:00:02Z"}]`}
+	sub.handleMessage(nil, msg)
+	require.True(t, msg.acked)
+	// acknowledged after valid datapoints were accepted by buffer, invalid one is dropped
+	require.Equal(t, 2, msg.buffered)
+	latest, ok := buffer.Latest().Get(id)
+	require.True(t, ok)
+	require.Equal(t, 3.0, latest.Value)
+
+	invalid := &fakeMessage{topic: topic, buffer: buffer, payload: `not json`}
+	sub.handleMessage(nil, invalid)
+	require.True(t, invalid.acked)
+	require.Equal(t, 2, invalid.buffered)
+
+	go buffer.RunDataHandler()
+	require.Eventually(t, func() bool { return buffer.ChannelLength() == 0 }, time.Second, 5*time.Millisecond)
+	buffer.Shutdown()
+	require.NoError(t, buffer.FlushBuffer())
+	require.Len(t, storage.Batches, 1)
+	require.Len(t, storage.Batches[0], 2)
+}
+
+// TestSubscriberWithBroker - runs against broker given in MQTT_BROKER, e.g. local mosquitto
+func TestSubscriberWithBroker(t *testing.T) {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_BROKER is not set")
+	}
+	buffer := &collector{}
+	sub, err := NewSubscriber(Config{BrokerURL: broker, QoS: 1, Topics: filters[:1]}, buffer)
+	require.NoError(t, err)
+	require.NoError(t, sub.Start())
+	defer sub.Stop()
+
+	pub := paho.NewClient(paho.NewClientOptions().AddBroker(broker))
+	token := pub.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+	defer pub.Disconnect(100)
+
+	topic := "devices/" + uuid.NewString() + "/measurements"
+	require.Eventually(t, func() bool {
+		pub.Publish(topic, 1, false, `{"value":1,"timestamp":"2021-11-01T10:00:00Z"}`).Wait()
+		return buffer.len() > 0
+	}, 5*time.Second, 200*time.Millisecond)
+}
@@ -0,0 +1,343 @@
+package partitions
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// lockID - key of advisory lock held during maintenance
+const lockID = 7351903
+
+const (
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+
+	RetentionDrop   = "drop"
+	RetentionDetach = "detach"
+)
+
+// Config - declarative range partitioning of measurements table by datetime, read from `storage.partitioning`
+// Interval - range of single partition: daily, weekly or monthly, aligned to UTC
+// Premake - number of partitions created ahead of current one
+// Retention - partitions which end before now-Retention are retired; disabled if zero
+// RetentionMode - `drop` removes retired partitions, `detach` leaves them as standalone tables
+// CheckInterval - period of maintenance runs
+type Config struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	Interval      string        `mapstructure:"interval"`
+	Premake       int           `mapstructure:"premake"`
+	Retention     time.Duration `mapstructure:"retention"`
+	RetentionMode string        `mapstructure:"retentionMode"`
+	CheckInterval time.Duration `mapstructure:"checkInterval"`
+}
+
+// Range - [From, To) of partition, zero From means unbounded (MINVALUE)
+type Range struct {
+	From time.Time
+	To   time.Time
+}
+
+// Partition - attached partition of table, default partition is never listed
+type Partition struct {
+	Name string
+	Range
+}
+
+// Manager - keeps partitions of table created ahead and retires old ones
+type Manager struct {
+	pool  *pgxpool.Pool
+	table pgx.Identifier
+	conf  Config
+}
+
+func New(pool *pgxpool.Pool, table string, conf Config) (*Manager, error) {
+	switch conf.Interval {
+	case "":
+		conf.Interval = Daily
+	case Daily, Weekly, Monthly:
+	default:
+		return nil, fmt.Errorf("unknown partitioning interval `%v`", conf.Interval)
+	}
+	switch conf.RetentionMode {
+	case "":
+		conf.RetentionMode = RetentionDrop
+	case RetentionDrop, RetentionDetach:
+	default:
+		return nil, fmt.Errorf("unknown partition retention mode `%v`", conf.RetentionMode)
+	}
+	if conf.Premake <= 0 {
+		conf.Premake = 3
+	}
+	if conf.CheckInterval <= 0 {
+		conf.CheckInterval = time.Hour
+	}
+	return &Manager{pool: pool, table: pgx.Identifier(strings.Split(table, ".")), conf: conf}, nil
+}
+
+// periodStart - start of interval period containing t
+func (m *Manager) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch m.conf.Interval {
+	case Weekly:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case Monthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return day
+	}
+}
+
+// nextBoundary - start of interval period following the one containing t
+func (m *Manager) nextBoundary(t time.Time) time.Time {
+	start := m.periodStart(t)
+	switch m.conf.Interval {
+	case Weekly:
+		return start.AddDate(0, 0, 7)
+	case Monthly:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// Plan - ranges to create so that current and Premake following periods are covered,
+// and partitions to retire; creation continues from the end of last existing partition
+func (m *Manager) Plan(existing []Partition, now time.Time) ([]Range, []Partition) {
+	cursor := m.periodStart(now)
+	if len(existing) > 0 {
+		last := existing[0].To
+		for _, p := range existing[1:] {
+			if p.To.After(last) {
+				last = p.To
+			}
+		}
+		cursor = last
+	}
+	horizon := m.periodStart(now)
+	for i := 0; i <= m.conf.Premake; i++ {
+		horizon = m.nextBoundary(horizon)
+	}
+	create := make([]Range, 0)
+	for cursor.Before(horizon) {
+		end := m.nextBoundary(cursor)
+		create = append(create, Range{From: cursor, To: end})
+		cursor = end
+	}
+
+	retire := make([]Partition, 0)
+	if m.conf.Retention > 0 {
+		cutoff := now.Add(-m.conf.Retention)
+		for _, p := range existing {
+			if !p.To.After(cutoff) {
+				retire = append(retire, p)
+			}
+		}
+	}
+	return create, retire
+}
+
+func (m *Manager) tableName() string {
+	return m.table[len(m.table)-1]
+}
+
+// child - identifier of table in schema of partitioned table
+func (m *Manager) child(name string) pgx.Identifier {
+	id := append(pgx.Identifier{}, m.table[:len(m.table)-1]...)
+	return append(id, name)
+}
+
+func (m *Manager) partitionName(r Range) string {
+	return m.tableName() + "_p" + r.From.UTC().Format("20060102")
+}
+
+// EnsurePartitioned - converts plain table into partitioned one, existing data is kept
+// in `<table>_legacy` partition covering everything before the next period after its latest row,
+// rows outside of created partitions go to `<table>_default`
+func (m *Manager) EnsurePartitioned(ctx context.Context, conn *pgxpool.Conn) error {
+	table := m.table.Sanitize()
+	var kind string
+	if err := conn.QueryRow(ctx, "SELECT relkind::text FROM pg_class WHERE oid = $1::regclass", table).Scan(&kind); err != nil {
+		return err
+	}
+	if kind == "p" {
+		return nil
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	legacy := m.child(m.tableName() + "_legacy").Sanitize()
+	index := m.tableName() + "_uid_datetime_key"
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %v RENAME TO %v", table, pgx.Identifier{m.tableName() + "_legacy"}.Sanitize()),
+		fmt.Sprintf("ALTER INDEX IF EXISTS %v RENAME TO %v", m.child(index).Sanitize(), pgx.Identifier{m.tableName() + "_legacy_uid_datetime_key"}.Sanitize()),
+		fmt.Sprintf("CREATE TABLE %v (LIKE %v INCLUDING DEFAULTS INCLUDING CONSTRAINTS) PARTITION BY RANGE (datetime)", table, legacy),
+		fmt.Sprintf("CREATE UNIQUE INDEX %v ON %v (uid, datetime)", pgx.Identifier{index}.Sanitize(), table),
+		fmt.Sprintf("CREATE TABLE %v PARTITION OF %v DEFAULT", m.child(m.tableName()+"_default").Sanitize(), table),
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(ctx, s); err != nil {
+			return err
+		}
+	}
+	var latest *time.Time
+	if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT max(datetime) FROM %v", legacy)).Scan(&latest); err != nil {
+		return err
+	}
+	if latest == nil {
+		_, err = tx.Exec(ctx, fmt.Sprintf("DROP TABLE %v", legacy))
+	} else {
+		_, err = tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %v ATTACH PARTITION %v FOR VALUES FROM (MINVALUE) TO ('%v')",
+			table, legacy, m.nextBoundary(*latest).Format(time.RFC3339)))
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+var upperBound = regexp.MustCompile(`FROM \((MINVALUE|'[^']+')\) TO \('([^']+)'\)`)
+
+// parseBound - parses timestamptz literal of partition bound as printed by postgres
+func parseBound(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999-07", "2006-01-02 15:04:05.999999-07:00", "2006-01-02 15:04:05.999999-07:00:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cant parse partition bound `%v`", s)
+}
+
+// Partitions - lists attached range partitions
+func (m *Manager) Partitions(ctx context.Context) ([]Partition, error) {
+	rows, err := m.pool.Query(ctx, `SELECT c.relname, pg_get_expr(c.relpartbound, c.oid)
+FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = $1::regclass`, m.table.Sanitize())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	partitions := make([]Partition, 0)
+	for rows.Next() {
+		var name, bound string
+		if err := rows.Scan(&name, &bound); err != nil {
+			return nil, err
+		}
+		match := upperBound.FindStringSubmatch(bound)
+		if match == nil {
+			// default partition
+			continue
+		}
+		p := Partition{Name: name}
+		if match[1] != "MINVALUE" {
+			if p.From, err = parseBound(strings.Trim(match[1], "'")); err != nil {
+				return nil, err
+			}
+		}
+		if p.To, err = parseBound(match[2]); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// create - creates partition for range, rows of this range already stored in default partition are moved into it
+func (m *Manager) create(ctx context.Context, r Range) error {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	table := m.table.Sanitize()
+	part := m.child(m.partitionName(r)).Sanitize()
+	from, to := r.From.Format(time.RFC3339), r.To.Format(time.RFC3339)
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %v (LIKE %v INCLUDING DEFAULTS INCLUDING CONSTRAINTS)", part, table),
+		fmt.Sprintf("WITH moved AS (DELETE FROM %v WHERE datetime >= '%v' AND datetime < '%v' RETURNING *) INSERT INTO %v SELECT * FROM moved",
+			m.child(m.tableName()+"_default").Sanitize(), from, to, part),
+		fmt.Sprintf("ALTER TABLE %v ATTACH PARTITION %v FOR VALUES FROM ('%v') TO ('%v')", table, part, from, to),
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(ctx, s); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (m *Manager) retire(ctx context.Context, p Partition) error {
+	part := m.child(p.Name).Sanitize()
+	if m.conf.RetentionMode == RetentionDetach {
+		_, err := m.pool.Exec(ctx, fmt.Sprintf("ALTER TABLE %v DETACH PARTITION %v", m.table.Sanitize(), part))
+		return err
+	}
+	_, err := m.pool.Exec(ctx, fmt.Sprintf("DROP TABLE %v", part))
+	return err
+}
+
+// Maintain - creates partitions ahead and retires expired ones,
+// does nothing if maintenance is already running in another collector
+func (m *Manager) Maintain(ctx context.Context, now time.Time) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", lockID).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked {
+		return nil
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", lockID)
+
+	existing, err := m.Partitions(ctx)
+	if err != nil {
+		return err
+	}
+	create, retire := m.Plan(existing, now)
+	for _, r := range create {
+		if err := m.create(ctx, r); err != nil {
+			return fmt.Errorf("cant create partition %v: %w", m.partitionName(r), err)
+		}
+		log.Printf("Created partition %v for [%v, %v)", m.partitionName(r), r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+	}
+	for _, p := range retire {
+		if err := m.retire(ctx, p); err != nil {
+			return fmt.Errorf("cant %v partition %v: %w", m.conf.RetentionMode, p.Name, err)
+		}
+		log.Printf("Retired partition %v ended at %v (%v)", p.Name, p.To.Format(time.RFC3339), m.conf.RetentionMode)
+	}
+	return nil
+}
+
+// Run - runs maintenance every CheckInterval until stop is closed
+func (m *Manager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(m.conf.CheckInterval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), m.conf.CheckInterval)
+		if err := m.Maintain(ctx, time.Now()); err != nil {
+			log.Printf("Partition maintenance failed: %v", err)
+		}
+		cancel()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package partitions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func day(s string) time.Time {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestPlanCreatesAheadFromLastPartition(t *testing.T) {
+	m, err := New(nil, "public.measurements", Config{Interval: Daily, Premake: 2, Retention: 48 * time.Hour})
+	require.NoError(t, err)
+	now := day("2021-11-10").Add(15 * time.Hour)
+
+	create, retire := m.Plan(nil, now)
+	require.Equal(t, []Range{
+		{From: day("2021-11-10"), To: day("2021-11-11")},
+		{From: day("2021-11-11"), To: day("2021-11-12")},
+		{From: day("2021-11-12"), To: day("2021-11-13")},
+	}, create)
+	require.Empty(t, retire)
+
+	existing := []Partition{
+		{Name: "measurements_legacy", Range: Range{To: day("2021-11-07")}},
+		{Name: "measurements_p20211107", Range: Range{From: day("2021-11-07"), To: day("2021-11-08")}},
+		{Name: "measurements_p20211108", Range: Range{From: day("2021-11-08"), To: day("2021-11-09")}},
+	}
+	create, retire = m.Plan(existing, now)
+	require.Len(t, create, 4)
+	require.Equal(t, day("2021-11-09"), create[0].From)
+	require.Equal(t, "measurements_p20211109", m.partitionName(create[0]))
+	require.Equal(t, []Partition{existing[0], existing[1]}, retire)
+}
+
+func TestPeriodBoundaries(t *testing.T) {
+	weekly, err := New(nil, "measurements", Config{Interval: Weekly})
+	require.NoError(t, err)
+	// 2021-11-10 is wednesday
+	require.Equal(t, day("2021-11-08"), weekly.periodStart(day("2021-11-10")))
+	require.Equal(t, day("2021-11-15"), weekly.nextBoundary(day("2021-11-14")))
+
+	monthly, err := New(nil, "measurements", Config{Interval: Monthly})
+	require.NoError(t, err)
+	require.Equal(t, day("2021-12-01"), monthly.nextBoundary(day("2021-11-30")))
+
+	_, err = New(nil, "measurements", Config{Interval: "hourly"})
+	require.Error(t, err)
+}
+
+func TestParseBound(t *testing.T) {
+	b, err := parseBound("2021-11-01 00:00:00+00")
+	require.NoError(t, err)
+	require.Equal(t, day("2021-11-01"), b)
+	b, err = parseBound("2021-11-01 05:30:00+05:30")
+	require.NoError(t, err)
+	require.Equal(t, day("2021-11-01"), b)
+
+	match := upperBound.FindStringSubmatch("FOR VALUES FROM (MINVALUE) TO ('2021-11-07 00:00:00+00')")
+	require.Equal(t, []string{"FROM (MINVALUE) TO ('2021-11-07 00:00:00+00')", "MINVALUE", "2021-11-07 00:00:00+00"}, match)
+	require.Nil(t, upperBound.FindStringSubmatch("DEFAULT"))
+}
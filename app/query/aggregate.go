@@ -0,0 +1,182 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	FillNone     = "none"
+	FillNull     = "null"
+	FillPrevious = "previous"
+	FillLinear   = "linear"
+
+	MaxBuckets = 10000
+)
+
+var (
+	ErrUnknownFunction = errors.New("unknown aggregate function")
+	ErrUnknownFill     = errors.New("unknown fill mode")
+	ErrInvalidBucket   = errors.New("bucket must be a duration of at least 1s, e.g. 1m, 1h, 1d")
+	ErrTooManyBuckets  = fmt.Errorf("time range contains more than %v buckets", MaxBuckets)
+)
+
+// aggregateFunctions - SQL expressions of supported aggregates
+var aggregateFunctions = map[string]string{
+	"avg":   "avg(value)",
+	"min":   "min(value)",
+	"max":   "max(value)",
+	"sum":   "sum(value)",
+	"count": "count(value)",
+	"first": "(array_agg(value ORDER BY datetime ASC))[1]",
+	"last":  "(array_agg(value ORDER BY datetime DESC))[1]",
+}
+
+// AggregateQuery - aggregate of device values per fixed bucket in [From, To),
+// buckets are aligned to unix epoch
+type AggregateQuery struct {
+	DeviceID uuid.UUID
+	Function string
+	Bucket   time.Duration
+	From     time.Time
+	To       time.Time
+	Fill     string
+}
+
+// Bucket - aggregated value of interval starting at Start, nil value means no data
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Value *float64  `json:"value"`
+}
+
+// ParseBucket - parses duration additionally accepting days, like `1d`
+func ParseBucket(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Second || d%time.Second != 0 {
+		return 0, ErrInvalidBucket
+	}
+	return d, nil
+}
+
+// Validate - checks function, fill mode and number of buckets
+func (q *AggregateQuery) Validate() error {
+	if _, ok := aggregateFunctions[q.Function]; !ok {
+		return ErrUnknownFunction
+	}
+	switch q.Fill {
+	case FillNone, FillNull, FillPrevious, FillLinear:
+	default:
+		return ErrUnknownFill
+	}
+	if q.Bucket < time.Second {
+		return ErrInvalidBucket
+	}
+	if q.To.Sub(q.From)/q.Bucket > MaxBuckets {
+		return ErrTooManyBuckets
+	}
+	return nil
+}
+
+// Aggregate - computes buckets in database and fills gaps according to fill mode
+func (r *Reader) Aggregate(ctx context.Context, q AggregateQuery) ([]Bucket, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	seconds := int64(q.Bucket / time.Second)
+	sql := fmt.Sprintf(`SELECT to_timestamp(floor(extract(epoch FROM datetime) / $4) * $4) AS bucket, %v::double precision
+FROM %v WHERE uid = $1 AND datetime >= $2 AND datetime < $3
+GROUP BY bucket ORDER BY bucket`, aggregateFunctions[q.Function], r.TableName)
+
+	rows, err := r.Pool.Query(ctx, sql, q.DeviceID, q.From, q.To, seconds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	buckets := make([]Bucket, 0)
+	for rows.Next() {
+		b := Bucket{}
+		if err := rows.Scan(&b.Start, &b.Value); err != nil {
+			return nil, err
+		}
+		b.Start = b.Start.UTC()
+		buckets = append(buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return FillBuckets(buckets, q.From, q.To, q.Bucket, q.Fill), nil
+}
+
+// bucketStart - start of bucket containing t, buckets are aligned to Unix epoch like in
+// Aggregate query, time.Truncate aligns them to zero time and differs for buckets like 7d
+func bucketStart(t time.Time, bucket time.Duration) time.Time {
+	seconds := int64(bucket / time.Second)
+	unix := t.Unix()
+	start := unix / seconds * seconds
+	if start > unix {
+		start -= seconds
+	}
+	return time.Unix(start, 0).UTC()
+}
+
+// FillBuckets - returns every bucket of [from, to) filling missing ones with null,
+// previous value or value interpolated between neighbours, `none` keeps only present buckets
+func FillBuckets(present []Bucket, from, to time.Time, bucket time.Duration, fill string) []Bucket {
+	if fill == FillNone {
+		return present
+	}
+	start := bucketStart(from, bucket)
+	filled := make([]Bucket, 0, int(to.Sub(start)/bucket)+1)
+	i := 0
+	for t := start; t.Before(to); t = t.Add(bucket) {
+		for i < len(present) && present[i].Start.Before(t) {
+			i++
+		}
+		if i < len(present) && present[i].Start.Equal(t) {
+			filled = append(filled, present[i])
+			continue
+		}
+		filled = append(filled, Bucket{Start: t})
+	}
+
+	switch fill {
+	case FillPrevious:
+		var prev *float64
+		for i := range filled {
+			if filled[i].Value == nil {
+				filled[i].Value = prev
+			}
+			prev = filled[i].Value
+		}
+	case FillLinear:
+		last := -1
+		for i := range filled {
+			if filled[i].Value == nil {
+				continue
+			}
+			if last >= 0 && i-last > 1 {
+				v0, v1 := *filled[last].Value, *filled[i].Value
+				for j := last + 1; j < i; j++ {
+					v := v0 + (v1-v0)*float64(j-last)/float64(i-last)
+					filled[j].Value = &v
+				}
+			}
+			last = i
+		}
+	}
+	return filled
+}
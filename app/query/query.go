@@ -0,0 +1,125 @@
+package query
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/qwlt/gmcollector/app/db"
+	"github.com/spf13/viper"
+)
+
+var R *Reader
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Point - stored measurement as returned by read API
+type Point struct {
+	DeviceID  uuid.UUID              `json:"id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Cursor - position of the last returned point in (datetime, uid) order
+type Cursor struct {
+	Timestamp time.Time
+	DeviceID  uuid.UUID
+}
+
+func (c Cursor) Encode() string {
+	raw := c.Timestamp.UTC().Format(time.RFC3339Nano) + "|" + c.DeviceID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidCursor
+	}
+	ts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Timestamp: ts, DeviceID: id}, nil
+}
+
+// RangeQuery - points of device in [From, To) ordered by time, starting after cursor
+type RangeQuery struct {
+	DeviceID uuid.UUID
+	From     time.Time
+	To       time.Time
+	Limit    int
+	After    *Cursor
+}
+
+// Reader - read access to stored measurements
+type Reader struct {
+	Pool      *pgxpool.Pool
+	TableName string
+}
+
+func NewReader(pool *pgxpool.Pool, tablename string) *Reader {
+	return &Reader{Pool: pool, TableName: tablename}
+}
+
+// GetReader - returns reader of table configured in `pool.tableName`
+func GetReader() *Reader {
+	if R == nil {
+		tablename := viper.GetString("pool.tableName")
+		if tablename == "" {
+			tablename = "measurements"
+		}
+		R = NewReader(db.GetDB(), tablename)
+	}
+	return R
+}
+
+// Measurements - returns page of points and cursor of the next page, nil cursor means last page
+func (r *Reader) Measurements(ctx context.Context, q RangeQuery) ([]Point, *Cursor, error) {
+	args := []interface{}{q.DeviceID, q.From, q.To}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "SELECT uid, datetime, value, metadata FROM %v WHERE uid = $1 AND datetime >= $2 AND datetime < $3", r.TableName)
+	if q.After != nil {
+		args = append(args, q.After.Timestamp, q.After.DeviceID)
+		sb.WriteString(" AND (datetime, uid) > ($4, $5)")
+	}
+	args = append(args, q.Limit+1)
+	fmt.Fprintf(&sb, " ORDER BY datetime, uid LIMIT $%v", len(args))
+
+	rows, err := r.Pool.Query(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	points := make([]Point, 0, q.Limit)
+	for rows.Next() {
+		p := Point{}
+		if err := rows.Scan(&p.DeviceID, &p.Timestamp, &p.Value, &p.Metadata); err != nil {
+			return nil, nil, err
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(points) <= q.Limit {
+		return points, nil, nil
+	}
+	points = points[:q.Limit]
+	last := points[len(points)-1]
+	return points, &Cursor{Timestamp: last.Timestamp, DeviceID: last.DeviceID}, nil
+}
@@ -0,0 +1,69 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{Timestamp: time.Date(2021, 11, 1, 10, 0, 0, 123456789, time.UTC), DeviceID: uuid.New()}
+	decoded, err := DecodeCursor(c.Encode())
+	require.NoError(t, err)
+	require.True(t, c.Timestamp.Equal(decoded.Timestamp))
+	require.Equal(t, c.DeviceID, decoded.DeviceID)
+
+	_, err = DecodeCursor("not a cursor")
+	require.Equal(t, ErrInvalidCursor, err)
+}
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func values(buckets []Bucket) []interface{} {
+	out := make([]interface{}, len(buckets))
+	for i, b := range buckets {
+		if b.Value != nil {
+			out[i] = *b.Value
+		}
+	}
+	return out
+}
+
+func TestParseBucket(t *testing.T) {
+	d, err := ParseBucket("5m")
+	require.NoError(t, err)
+	require.Equal(t, 5*time.Minute, d)
+	d, err = ParseBucket("1d")
+	require.NoError(t, err)
+	require.Equal(t, 24*time.Hour, d)
+	_, err = ParseBucket("500ms")
+	require.Equal(t, ErrInvalidBucket, err)
+}
+
+func TestFillBuckets(t *testing.T) {
+	from := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(5 * time.Minute)
+	present := []Bucket{
+		{Start: from.Add(time.Minute), Value: value(1)},
+		{Start: from.Add(4 * time.Minute), Value: value(4)},
+	}
+
+	require.Len(t, FillBuckets(present, from, to, time.Minute, FillNone), 2)
+	require.Equal(t, []interface{}{nil, 1.0, nil, nil, 4.0}, values(FillBuckets(present, from, to, time.Minute, FillNull)))
+	require.Equal(t, []interface{}{nil, 1.0, 1.0, 1.0, 4.0}, values(FillBuckets(present, from, to, time.Minute, FillPrevious)))
+	require.Equal(t, []interface{}{nil, 1.0, 2.0, 3.0, 4.0}, values(FillBuckets(present, from, to, time.Minute, FillLinear)))
+
+	// week buckets start on Thursday like Unix epoch, as computed by database
+	week := 7 * 24 * time.Hour
+	weekStart := time.Date(2021, 10, 28, 0, 0, 0, 0, time.UTC)
+	present = []Bucket{{Start: weekStart, Value: value(1)}, {Start: weekStart.Add(2 * week), Value: value(3)}}
+	filled := FillBuckets(present, from, from.Add(3*week), week, FillNull)
+	require.Equal(t, weekStart, filled[0].Start)
+	require.Equal(t, []interface{}{1.0, nil, 3.0, nil}, values(filled))
+
+	require.Equal(t, time.Unix(-7*60, 0).UTC(), bucketStart(time.Unix(-1, 0), 7*time.Minute))
+}
@@ -0,0 +1,114 @@
+package rejectlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/qwlt/gmcollector/app/models"
+)
+
+// Config - log of datapoints rejected by storage, read from `pool.rejectLog` section
+// Path - file where rejected datapoints are appended as JSON lines
+// MaxSize - size in bytes after which file is rotated to `<path>.1`, previous rotated file is replaced
+type Config struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Path    string `mapstructure:"path"`
+	MaxSize int64  `mapstructure:"maxSize"`
+}
+
+// Entry - rejected datapoint along with database error
+type Entry struct {
+	Time      time.Time          `json:"time"`
+	Error     string             `json:"error"`
+	Code      string             `json:"code,omitempty"`
+	Datapoint models.Measurement `json:"datapoint"`
+}
+
+// Log - append only JSON lines file
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func Open(conf Config) (*Log, error) {
+	path := conf.Path
+	if path == "" {
+		path = "rejected.jsonl"
+	}
+	if conf.MaxSize <= 0 {
+		conf.MaxSize = 64 << 20
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	l := &Log{path: path, maxSize: conf.MaxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+func (l *Log) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Write - appends entries and syncs file
+func (l *Log) Write(entries []Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size >= l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(l.f)
+	for i := range entries {
+		raw, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		raw = append(raw, '\n')
+		n, err := w.Write(raw)
+		l.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
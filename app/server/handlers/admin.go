@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/qwlt/gmcollector/app/deadletter"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+)
+
+func deadLetterStore(c *fiber.Ctx) (*buff.WriteBuffer, *deadletter.Store, error) {
+	b, err := buff.GetBuffer()
+	if err != nil {
+		return nil, nil, err
+	}
+	store := b.DeadLetter()
+	if store == nil {
+		return nil, nil, c.Status(fiber.StatusNotFound).JSON(&fiber.Map{"errors": "dead letter store is disabled"})
+	}
+	return b, store, nil
+}
+
+func deadLetterError(c *fiber.Ctx, err error) error {
+	if err == deadletter.ErrBatchNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(&fiber.Map{"errors": err.Error()})
+	}
+	log.Println(err)
+	return c.Status(fiber.StatusInternalServerError).JSON(&fiber.Map{"errors": err.Error()})
+}
+
+// ListDeadLetterHandler - lists batches which failed all write attempts
+func ListDeadLetterHandler(c *fiber.Ctx) error {
+	_, store, err := deadLetterStore(c)
+	if store == nil {
+		return err
+	}
+	batches, err := store.List()
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+	return c.JSON(&fiber.Map{"batches": batches})
+}
+
+func GetDeadLetterHandler(c *fiber.Ctx) error {
+	_, store, err := deadLetterStore(c)
+	if store == nil {
+		return err
+	}
+	batch, err := store.Load(c.Params("id"))
+	if err != nil {
+		return deadLetterError(c, err)
+	}
+	return c.JSON(batch)
+}
+
+// ReplayDeadLetterHandler - re-injects batch into write buffer and removes it from the store
+func ReplayDeadLetterHandler(c *fiber.Ctx) error {
+	b, store, err := deadLetterStore(c)
+	if store == nil {
+		return err
+	}
+	n, err := b.ReinjectDeadLetter(c.Params("id"))
+	if err != nil {
+		if err == deadletter.ErrBatchNotFound {
+			return deadLetterError(c, err)
+		}
+		log.Println(err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(&fiber.Map{"reinjected": n, "errors": err.Error()})
+	}
+	return c.JSON(&fiber.Map{"reinjected": n})
+}
+
+func DeleteDeadLetterHandler(c *fiber.Ctx) error {
+	_, store, err := deadLetterStore(c)
+	if store == nil {
+		return err
+	}
+	if err := store.Remove(c.Params("id")); err != nil {
+		return deadLetterError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+)
+
+// HeaderPriority - request header, `low` marks datapoints which are shed first under load
+const HeaderPriority = "X-Priority"
+
+func requestPriority(c *fiber.Ctx) buff.Priority {
+	if strings.EqualFold(c.Get(HeaderPriority), "low") {
+		return buff.PriorityLow
+	}
+	return buff.PriorityNormal
+}
+
+// bufferErrorStatus - maps error of write buffer to response status, when buffer is overloaded
+// sets Retry-After computed from its drain rate: shed low priority traffic gets 429, full buffer 503
+func bufferErrorStatus(c *fiber.Ctx, b *buff.WriteBuffer, err error) int {
+	if !buff.IsOverloaded(err) {
+		return fiber.StatusInternalServerError
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(b.RetryAfter()/time.Second)))
+	if errors.Is(err, buff.ErrShed) {
+		return fiber.StatusTooManyRequests
+	}
+	return fiber.StatusServiceUnavailable
+}
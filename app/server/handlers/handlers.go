@@ -1,36 +1,29 @@
 package handlers
 
 import (
-	"fmt"
 	"log"
 
-	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	"github.com/qwlt/gmcollector/app/metrics"
 	"github.com/qwlt/gmcollector/app/models"
 	buff "github.com/qwlt/gmcollector/app/writebuffer"
 )
 
-var validate *validator.Validate
-
 func TestHandler(c *fiber.Ctx) error {
-	mv := MeasurementValidator{}
+	mv := models.MeasurementValidator{}
 	if err := c.BodyParser(&mv); err != nil {
+		metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultRejected).Inc()
 		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
 	}
 
-	err := validate.Struct(&mv)
-	if err != nil {
-		// log.Println(err.Error())
-		responseMap := make(fiber.Map)
-		responseMap["errors"] = make(fiber.Map)
-		for _, err := range err.(validator.ValidationErrors) {
-			key := err.Field()
-			errorMessage := fmt.Sprintf("Validation error: %v", err.Tag())
-			errors := responseMap["errors"].(fiber.Map)
-			errors[key] = errorMessage
-		}
-
-		return c.Status(fiber.StatusBadRequest).JSON(&responseMap)
+	if errors := models.ValidateMeasurement(&mv); errors != nil {
+		metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultRejected).Inc()
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": errors})
+	}
+	if !canWriteDevice(c, &mv) {
+		metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultRejected).Inc()
+		return c.Status(fiber.StatusForbidden).JSON(&fiber.Map{"errors": fiber.Map{"DeviceID": errDeviceForbidden}})
 	}
 
 	b, err := buff.GetBuffer()
@@ -38,14 +31,36 @@ func TestHandler(c *fiber.Ctx) error {
 		log.Println(err)
 		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
 	}
-	err = b.AddDatapoint(models.Measurement{DeviceID: mv.DeviceID, Value: mv.Value, Timestamp: mv.Timestamp})
+	var ack *buff.Ack
+	if writeThrough(c) {
+		ack, err = b.AddDatapointSync(mv.Measurement(), requestPriority(c))
+	} else {
+		err = b.AddDatapointPriority(mv.Measurement(), requestPriority(c))
+	}
 	if err != nil {
 		log.Println(err)
-		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
+		metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultRejected).Inc()
+		return c.Status(bufferErrorStatus(c, b, err)).JSON(&fiber.Map{"errors": err.Error()})
 	}
+	if ack != nil {
+		if err := ack.Wait(b.SyncTimeout()); err != nil {
+			log.Println(err)
+			metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultRejected).Inc()
+			return c.Status(ackErrorStatus(err)).JSON(&fiber.Map{"errors": err.Error()})
+		}
+	}
+	metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultAccepted).Inc()
 	return c.SendStatus(fiber.StatusCreated)
 }
 
+const errDeviceForbidden = "API key is not allowed to write data of this device"
+
+// canWriteDevice - checks device of measurement against principal resolved by auth middleware
+func canWriteDevice(c *fiber.Ctx, mv *models.MeasurementValidator) bool {
+	p := apikeys.FromContext(c)
+	return p == nil || p.CanAccessDevice(mv.DeviceID)
+}
+
 func AnotherHandler(ctx *fiber.Ctx) error {
 
 	return ctx.JSON(fiber.Map{
@@ -53,10 +68,6 @@ func AnotherHandler(ctx *fiber.Ctx) error {
 	})
 }
 
-func InitValidator() {
-	validate = validator.New()
-}
-
 func MainHandler(ctx *fiber.Ctx) error {
 	return ctx.JSON(fiber.Map{
 		"message": "working",
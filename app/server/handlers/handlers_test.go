@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	"github.com/qwlt/gmcollector/app/metrics"
+	"github.com/qwlt/gmcollector/app/models"
+	"github.com/qwlt/gmcollector/app/server/middlewares"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	validItem   = `{"id":"0b7e1c1c-7d0a-4f3e-9a39-3c4b8f6e2a10","value":1.5,"timestamp":"2021-11-01T10:00:00Z","metadata":{"fw":"1.0.2"}}`
+	invalidItem = `{"id":"0b7e1c1c-7d0a-4f3e-9a39-3c4b8f6e2a10","timestamp":"2021-11-01T10:00:00Z","metadata":{"a":1,"b":2,"c":3}}`
+)
+
+func setupTestBuffer(t *testing.T) {
+	models.InitValidator(models.MetadataLimits{MaxKeys: 2, MaxBytes: 256})
+	buff.WB = buff.NewWriteBuffer(&buff.WBufferConfig{BufMaxSize: 100, WriteTimeout: 10}, &buff.MockStorage{})
+	t.Cleanup(func() { buff.WB = nil })
+}
+
+func newTestApp() *fiber.App {
+	return fiber.New(fiber.Config{JSONEncoder: json.Marshal, JSONDecoder: json.Unmarshal})
+}
+
+func setupTestApp(t *testing.T) *fiber.App {
+	setupTestBuffer(t)
+	app := newTestApp()
+	app.Post("/test", TestHandler)
+	app.Post("/v1/measurements", IngestMeasurementsHandler)
+	return app
+}
+
+var (
+	boundDevice = uuid.MustParse("0b7e1c1c-7d0a-4f3e-9a39-3c4b8f6e2a10")
+	otherItem   = `{"id":"5f0c3d1e-2b8a-4c55-8d0e-7a7b6c5d4e3f","value":2.5,"timestamp":"2021-11-01T10:00:00Z"}`
+)
+
+// setupAuthTestApp - app with auth middleware resolving tokens of static principals
+func setupAuthTestApp(t *testing.T) *fiber.App {
+	setupTestBuffer(t)
+	principals := map[string]*apikeys.Principal{
+		"bound":    apikeys.NewPrincipal(uuid.New(), []string{apikeys.ScopeWrite}, []uuid.UUID{boundDevice}),
+		"any":      apikeys.NewPrincipal(uuid.New(), []string{apikeys.ScopeWrite}, nil),
+		"readonly": apikeys.NewPrincipal(uuid.New(), []string{apikeys.ScopeRead}, nil),
+		"reader":   apikeys.NewPrincipal(uuid.New(), []string{apikeys.ScopeRead}, []uuid.UUID{boundDevice}),
+	}
+	app := newTestApp()
+	app.Use(middlewares.New(middlewares.Config{
+		ContextKey: apikeys.ContextKey,
+		Resolver: func(c *fiber.Ctx, token string) (interface{}, error) {
+			if p, ok := principals[token]; ok {
+				return p, nil
+			}
+			return nil, apikeys.ErrInvalidKey
+		},
+	}))
+	app.Post("/test", apikeys.RequireScope(apikeys.ScopeWrite), TestHandler)
+	app.Post("/v1/measurements", apikeys.RequireScope(apikeys.ScopeWrite), IngestMeasurementsHandler)
+	app.Get("/v1/devices/:id/measurements", apikeys.RequireScope(apikeys.ScopeRead), ReadMeasurementsHandler)
+	app.Get("/v1/devices/:id/aggregate", apikeys.RequireScope(apikeys.ScopeRead), AggregateHandler)
+	app.Get("/v1/devices/:id/latest", apikeys.RequireScope(apikeys.ScopeRead), LatestHandler)
+	app.Get("/v1/latest", apikeys.RequireScope(apikeys.ScopeRead), LatestManyHandler)
+	app.Get("/v1/latest/stale", apikeys.RequireScope(apikeys.ScopeRead), StaleDevicesHandler)
+	app.Get("/v1/stream", apikeys.RequireScope(apikeys.ScopeRead), StreamHandler)
+	app.Get("/v1/stream/ws", apikeys.RequireScope(apikeys.ScopeRead), StreamUpgradeHandler, StreamWebSocketHandler)
+	return app
+}
+
+func doRequest(t *testing.T, app *fiber.App, path, contentType, body string) (int, []byte) {
+	return doAuthRequest(t, app, path, contentType, body, "")
+}
+
+func doAuthRequest(t *testing.T, app *fiber.App, path, contentType, body, token string) (int, []byte) {
+	method := "POST"
+	if body == "" {
+		method = "GET"
+	}
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(fiber.HeaderContentType, contentType)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := app.Test(req)
+	require.NoError(t, err)
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, raw
+}
+
+func TestIngestJSONArrayReportsPerItem(t *testing.T) {
+	app := setupTestApp(t)
+	status, raw := doRequest(t, app, "/v1/measurements", fiber.MIMEApplicationJSON, "["+validItem+","+invalidItem+",42]")
+	require.Equal(t, fiber.StatusMultiStatus, status)
+
+	var report IngestReport
+	require.NoError(t, json.Unmarshal(raw, &report))
+	require.Equal(t, 1, report.Accepted)
+	require.Equal(t, 2, report.Rejected)
+	require.Equal(t, StatusAccepted, report.Results[0].Status)
+	require.Equal(t, StatusRejected, report.Results[1].Status)
+	require.Contains(t, report.Results[1].Errors, "Value")
+	require.Contains(t, report.Results[1].Errors, "Metadata")
+	require.Contains(t, report.Results[2].Errors, "body")
+}
+
+func TestIngestNDJSON(t *testing.T) {
+	app := setupTestApp(t)
+	status, raw := doRequest(t, app, "/v1/measurements", ndjsonContentType, validItem+"\n\n"+validItem+"\n")
+	require.Equal(t, fiber.StatusCreated, status)
+
+	var report IngestReport
+	require.NoError(t, json.Unmarshal(raw, &report))
+	require.Equal(t, 2, report.Accepted)
+	require.Equal(t, 0, report.Rejected)
+}
+
+func TestIngestAllRejected(t *testing.T) {
+	app := setupTestApp(t)
+	status, _ := doRequest(t, app, "/v1/measurements", fiber.MIMEApplicationJSON, "["+invalidItem+"]")
+	require.Equal(t, fiber.StatusBadRequest, status)
+
+	status, _ = doRequest(t, app, "/v1/measurements", fiber.MIMEApplicationJSON, "{}")
+	require.Equal(t, fiber.StatusBadRequest, status)
+}
+
+func TestSingleMeasurementWithMetadata(t *testing.T) {
+	app := setupTestApp(t)
+	status, _ := doRequest(t, app, "/test", fiber.MIMEApplicationJSON, validItem)
+	require.Equal(t, fiber.StatusCreated, status)
+
+	status, _ = doRequest(t, app, "/test", fiber.MIMEApplicationJSON, invalidItem)
+	require.Equal(t, fiber.StatusBadRequest, status)
+}
+
+func TestBufferHealth(t *testing.T) {
+	now := time.Now()
+	ready, components := bufferHealth(buff.Health{Running: true, FlushInterval: time.Second, LastSuccess: now.Add(-2 * time.Second)}, now)
+	require.True(t, ready)
+	require.Equal(t, componentUp, components["flush"].(fiber.Map)["status"])
+
+	ready, components = bufferHealth(buff.Health{Running: true, FlushInterval: time.Second, LastSuccess: now.Add(-time.Minute), LastError: errors.New("db is down")}, now)
+	require.False(t, ready)
+	require.Equal(t, "db is down", components["flush"].(fiber.Map)["lastError"])
+
+	ready, components = bufferHealth(buff.Health{FlushInterval: time.Second, LastSuccess: now}, now)
+	require.False(t, ready)
+	require.Equal(t, componentDown, components["dataHandler"].(fiber.Map)["status"])
+}
+
+func TestTokenRestrictedToBoundDevice(t *testing.T) {
+	app := setupAuthTestApp(t)
+	status, _ := doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, validItem, "bound")
+	require.Equal(t, fiber.StatusCreated, status)
+
+	status, raw := doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, otherItem, "bound")
+	require.Equal(t, fiber.StatusForbidden, status)
+	require.Contains(t, string(raw), "DeviceID")
+
+	status, _ = doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, otherItem, "any")
+	require.Equal(t, fiber.StatusCreated, status)
+}
+
+func TestBulkRejectsForeignDevices(t *testing.T) {
+	app := setupAuthTestApp(t)
+	status, raw := doAuthRequest(t, app, "/v1/measurements", fiber.MIMEApplicationJSON, "["+validItem+","+otherItem+"]", "bound")
+	require.Equal(t, fiber.StatusMultiStatus, status)
+	var report IngestReport
+	require.NoError(t, json.Unmarshal(raw, &report))
+	require.Equal(t, StatusAccepted, report.Results[0].Status)
+	require.Equal(t, StatusRejected, report.Results[1].Status)
+	require.Contains(t, report.Results[1].Errors, "DeviceID")
+
+	status, _ = doAuthRequest(t, app, "/v1/measurements", fiber.MIMEApplicationJSON, "["+otherItem+"]", "bound")
+	require.Equal(t, fiber.StatusForbidden, status)
+}
+
+func TestAuthFailures(t *testing.T) {
+	app := setupAuthTestApp(t)
+	status, _ := doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, validItem, "")
+	require.Equal(t, fiber.StatusBadRequest, status)
+
+	status, _ = doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, validItem, "unknown")
+	require.Equal(t, fiber.StatusUnauthorized, status)
+
+	status, _ = doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, validItem, "readonly")
+	require.Equal(t, fiber.StatusForbidden, status)
+}
+
+func TestReadMeasurementsRejectsBadRequests(t *testing.T) {
+	app := setupAuthTestApp(t)
+	path := "/v1/devices/" + boundDevice.String() + "/measurements"
+
+	status, _ := doAuthRequest(t, app, path, "", "", "bound")
+	require.Equal(t, fiber.StatusForbidden, status)
+
+	status, _ = doAuthRequest(t, app, "/v1/devices/"+uuid.NewString()+"/measurements", "", "", "reader")
+	require.Equal(t, fiber.StatusForbidden, status)
+
+	status, _ = doAuthRequest(t, app, "/v1/devices/not-uuid/measurements", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+
+	status, raw := doAuthRequest(t, app, path+"?from=yesterday&limit=5000&cursor=zzz", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+	var body struct {
+		Errors map[string]string `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &body))
+	require.Contains(t, body.Errors, "from")
+	require.Contains(t, body.Errors, "limit")
+	require.Contains(t, body.Errors, "cursor")
+
+	status, _ = doAuthRequest(t, app, path+"?from=2021-11-02T00:00:00Z&to=2021-11-01T00:00:00Z", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+}
+
+func TestAggregateRejectsBadParams(t *testing.T) {
+	app := setupAuthTestApp(t)
+	path := "/v1/devices/" + boundDevice.String() + "/aggregate"
+
+	status, raw := doAuthRequest(t, app, path+"?fn=median&bucket=5x&fill=spline", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+	var body struct {
+		Errors map[string]string `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &body))
+	require.Contains(t, body.Errors, "bucket")
+
+	status, raw = doAuthRequest(t, app, path+"?fn=median", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+	require.Contains(t, string(raw), "fn")
+
+	status, _ = doAuthRequest(t, app, path+"?bucket=1s&from=2021-01-01T00:00:00Z&to=2021-02-01T00:00:00Z", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+}
+
+func TestLatestValues(t *testing.T) {
+	app := setupAuthTestApp(t)
+	status, _ := doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, validItem, "any")
+	require.Equal(t, fiber.StatusCreated, status)
+	status, _ = doAuthRequest(t, app, "/test", fiber.MIMEApplicationJSON, otherItem, "any")
+	require.Equal(t, fiber.StatusCreated, status)
+
+	status, raw := doAuthRequest(t, app, "/v1/devices/"+boundDevice.String()+"/latest", "", "", "reader")
+	require.Equal(t, fiber.StatusOK, status)
+	var latest buff.Latest
+	require.NoError(t, json.Unmarshal(raw, &latest))
+	require.Equal(t, 1.5, latest.Value)
+
+	other := "5f0c3d1e-2b8a-4c55-8d0e-7a7b6c5d4e3f"
+	status, _ = doAuthRequest(t, app, "/v1/latest?ids="+boundDevice.String()+","+other, "", "", "reader")
+	require.Equal(t, fiber.StatusForbidden, status)
+
+	missing := uuid.New().String()
+	status, raw = doAuthRequest(t, app, "/v1/latest?ids="+other+","+missing, "", "", "readonly")
+	require.Equal(t, fiber.StatusOK, status)
+	var many struct {
+		Data    []buff.Latest `json:"data"`
+		Missing []string      `json:"missing"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &many))
+	require.Len(t, many.Data, 1)
+	require.Equal(t, []string{missing}, many.Missing)
+
+	status, raw = doAuthRequest(t, app, "/v1/latest/stale?threshold=1h", "", "", "reader")
+	require.Equal(t, fiber.StatusOK, status)
+	require.NoError(t, json.Unmarshal(raw, &many))
+	require.Len(t, many.Data, 1)
+	require.Equal(t, boundDevice, many.Data[0].DeviceID)
+}
+
+func TestStreamRejectsBadParams(t *testing.T) {
+	app := setupAuthTestApp(t)
+	status, _ := doAuthRequest(t, app, "/v1/stream?device=nope", "", "", "reader")
+	require.Equal(t, fiber.StatusBadRequest, status)
+	status, _ = doAuthRequest(t, app, "/v1/stream?device="+uuid.New().String(), "", "", "reader")
+	require.Equal(t, fiber.StatusForbidden, status)
+	status, _ = doAuthRequest(t, app, "/v1/stream/ws", "", "", "reader")
+	require.Equal(t, fiber.StatusUpgradeRequired, status)
+}
+
+func TestOverloadedBufferSignalsBackpressure(t *testing.T) {
+	app := setupTestApp(t)
+	buff.WB = buff.NewWriteBuffer(&buff.WBufferConfig{BufMaxSize: 2, WriteTimeout: 10,
+		Admission: buff.AdmissionConfig{Policy: buff.AdmissionShed, ShedThreshold: 0.5}}, &buff.MockStorage{})
+
+	send := func(priority string) *http.Response {
+		req := httptest.NewRequest("POST", "/test", strings.NewReader(validItem))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(HeaderPriority, priority)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		return resp
+	}
+	require.Equal(t, fiber.StatusCreated, send("low").StatusCode)
+
+	resp := send("low")
+	require.Equal(t, fiber.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "5", resp.Header.Get(fiber.HeaderRetryAfter))
+
+	require.Equal(t, fiber.StatusCreated, send("").StatusCode)
+	buff.WB.Conf.Admission.Policy = buff.AdmissionReject
+	resp = send("")
+	require.Equal(t, fiber.StatusServiceUnavailable, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get(fiber.HeaderRetryAfter))
+
+	status, _ := doRequest(t, app, "/v1/measurements", fiber.MIMEApplicationJSON, "["+validItem+"]")
+	require.Equal(t, fiber.StatusServiceUnavailable, status)
+}
+
+func TestWriteThroughWaitsForCommit(t *testing.T) {
+	app := setupTestApp(t)
+	storage := &buff.RejectingStorage{Bad: -1}
+	buff.WB = buff.NewWriteBuffer(&buff.WBufferConfig{BufMaxSize: 100, WriteTimeout: 10,
+		MaxAge: 20 * time.Millisecond}, storage)
+	go buff.WB.RunDataHandler()
+	defer buff.WB.Shutdown()
+
+	send := func(path, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(HeaderPrefer, "respond-async, sync")
+		resp, err := app.Test(req, 2000)
+		require.NoError(t, err)
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, raw
+	}
+	resp, _ := send("/test", validItem)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	require.Equal(t, preferSync, resp.Header.Get(HeaderPreferenceApplied))
+	require.Len(t, storage.Written, 1)
+
+	accepted := metrics.Datapoints.WithLabelValues(metrics.SourceHTTP, metrics.ResultAccepted)
+	before := testutil.ToFloat64(accepted)
+	bad := `{"id":"5f0c3d1e-2b8a-4c55-8d0e-7a7b6c5d4e3f","value":-1,"timestamp":"2021-11-01T10:00:00Z"}`
+	resp, _ = send("/test", bad)
+	require.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, before, testutil.ToFloat64(accepted), "datapoint failed to commit is not accepted")
+
+	bad = strings.Replace(bad, "5f0c3d1e", "6a1d4e2f", 1)
+	resp, raw := send("/v1/measurements", "["+otherItem+","+bad+"]")
+	require.Equal(t, fiber.StatusMultiStatus, resp.StatusCode)
+	var report IngestReport
+	require.NoError(t, json.Unmarshal(raw, &report))
+	require.Equal(t, 1, report.Accepted)
+	require.Equal(t, 1, report.Rejected)
+	require.Equal(t, StatusAccepted, report.Results[0].Status)
+	require.Equal(t, StatusRejected, report.Results[1].Status)
+	require.Contains(t, report.Results[1].Errors, "storage")
+}
+
+func TestAckErrorStatus(t *testing.T) {
+	require.Equal(t, fiber.StatusGatewayTimeout, ackErrorStatus(buff.ErrAckTimeout))
+	require.Equal(t, fiber.StatusServiceUnavailable, ackErrorStatus(buff.ErrNotWritten))
+	require.Equal(t, fiber.StatusInternalServerError, ackErrorStatus(errors.New("connection refused")))
+}
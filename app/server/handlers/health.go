@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/qwlt/gmcollector/app/db"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+)
+
+const (
+	componentUp   = "up"
+	componentDown = "down"
+)
+
+// HealthConfig - readiness check settings
+// FlushFactor - collector is not ready if last successful flush is older than FlushFactor flush intervals
+// PingTimeout - max duration of database ping
+type HealthConfig struct {
+	FlushFactor int           `mapstructure:"flushFactor"`
+	PingTimeout time.Duration `mapstructure:"pingTimeout"`
+}
+
+var healthConf = HealthConfig{FlushFactor: 3, PingTimeout: time.Second}
+
+func InitHealth(conf HealthConfig) {
+	if conf.FlushFactor > 0 {
+		healthConf.FlushFactor = conf.FlushFactor
+	}
+	if conf.PingTimeout > 0 {
+		healthConf.PingTimeout = conf.PingTimeout
+	}
+}
+
+// LivenessHandler - reports that process is alive and able to serve requests
+func LivenessHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{"status": "alive"})
+}
+
+// ReadinessHandler - reports whether collector is able to persist data,
+// responds 503 if any of components is down
+func ReadinessHandler(c *fiber.Ctx) error {
+	components := fiber.Map{}
+	ready := true
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthConf.PingTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := db.GetDB().Ping(ctx); err != nil {
+		ready = false
+		components["database"] = fiber.Map{"status": componentDown, "error": err.Error()}
+	} else {
+		components["database"] = fiber.Map{"status": componentUp, "latency": time.Since(start).String()}
+	}
+
+	b, err := buff.GetBuffer()
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "not ready", "errors": err.Error()})
+	}
+	bufferReady, bufferComponents := bufferHealth(b.Health(), time.Now())
+	for k, v := range bufferComponents {
+		components[k] = v
+	}
+	ready = ready && bufferReady
+
+	if !ready {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"status": "not ready", "components": components})
+	}
+	return c.JSON(fiber.Map{"status": "ready", "components": components})
+}
+
+func bufferHealth(h buff.Health, now time.Time) (bool, fiber.Map) {
+	ready := true
+	components := fiber.Map{}
+	if h.Running {
+		components["dataHandler"] = fiber.Map{"status": componentUp}
+	} else {
+		ready = false
+		components["dataHandler"] = fiber.Map{"status": componentDown}
+	}
+
+	flush := fiber.Map{"status": componentUp}
+	deadline := h.FlushInterval * time.Duration(healthConf.FlushFactor)
+	if h.LastSuccess.IsZero() || now.Sub(h.LastSuccess) > deadline {
+		ready = false
+		flush["status"] = componentDown
+	}
+	if !h.LastSuccess.IsZero() {
+		flush["lastSuccess"] = h.LastSuccess
+	}
+	if h.LastError != nil {
+		flush["lastError"] = h.LastError.Error()
+		flush["lastErrorAt"] = h.LastErrorAt
+	}
+	components["flush"] = flush
+	return ready, components
+}
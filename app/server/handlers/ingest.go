@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/qwlt/gmcollector/app/metrics"
+	"github.com/qwlt/gmcollector/app/models"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	maxNDJSONLineSize = 1 << 20
+
+	StatusAccepted = "accepted"
+	StatusRejected = "rejected"
+)
+
+// ItemResult - outcome of a single measurement in bulk request
+type ItemResult struct {
+	Index  int       `json:"index"`
+	Status string    `json:"status"`
+	Errors fiber.Map `json:"errors,omitempty"`
+}
+
+// IngestReport - response body of bulk ingestion endpoint
+type IngestReport struct {
+	Accepted int          `json:"accepted"`
+	Rejected int          `json:"rejected"`
+	Results  []ItemResult `json:"results"`
+}
+
+// IngestMeasurementsHandler - accepts JSON array or NDJSON stream of measurements,
+// valid ones are pushed into write buffer together, invalid are reported per item;
+// in write-through mode items which failed to be committed are reported as rejected too
+func IngestMeasurementsHandler(c *fiber.Ctx) error {
+	items, err := splitItems(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
+	}
+
+	report := IngestReport{Results: make([]ItemResult, len(items))}
+	datapoints := make([]models.Model, 0, len(items))
+	indexes := make([]int, 0, len(items))
+	forbidden := 0
+	for i, raw := range items {
+		report.Results[i].Index = i
+		mv := models.MeasurementValidator{}
+		if err := json.Unmarshal(raw, &mv); err != nil {
+			report.reject(i, fiber.Map{"body": err.Error()})
+			continue
+		}
+		if errors := models.ValidateMeasurement(&mv); errors != nil {
+			report.reject(i, fiber.Map(errors))
+			continue
+		}
+		if !canWriteDevice(c, &mv) {
+			report.reject(i, fiber.Map{"DeviceID": errDeviceForbidden})
+			forbidden++
+			continue
+		}
+		datapoints = append(datapoints, mv.Measurement())
+		indexes = append(indexes, i)
+	}
+
+	bufferStatus, storageStatus := 0, 0
+	if len(datapoints) > 0 {
+		b, err := buff.GetBuffer()
+		if err != nil {
+			log.Println(err)
+			return c.Status(fiber.StatusInternalServerError).JSON(&fiber.Map{"errors": err.Error()})
+		}
+		var n int
+		var acks []*buff.Ack
+		if writeThrough(c) {
+			acks, err = b.AddDatapointsSync(datapoints, requestPriority(c))
+			n = len(acks)
+		} else {
+			n, err = b.AddDatapointsPriority(datapoints, requestPriority(c))
+		}
+		for _, i := range indexes[:n] {
+			report.Results[i].Status = StatusAccepted
+			report.Accepted++
+		}
+		if err != nil {
+			log.Println(err)
+			bufferStatus = bufferErrorStatus(c, b, err)
+			for _, i := range indexes[n:] {
+				report.reject(i, fiber.Map{"buffer": err.Error()})
+			}
+		}
+		deadline := time.Now().Add(b.SyncTimeout())
+		for j, ack := range acks {
+			if err := ack.Wait(time.Until(deadline)); err != nil {
+				log.Println(err)
+				report.Accepted--
+				report.reject(indexes[j], fiber.Map{"storage": err.Error()})
+				storageStatus = ackErrorStatus(err)
+			}
+		}
+	}
+
+	metrics.Datapoints.WithLabelValues(metrics.SourceBulk, metrics.ResultAccepted).Add(float64(report.Accepted))
+	metrics.Datapoints.WithLabelValues(metrics.SourceBulk, metrics.ResultRejected).Add(float64(report.Rejected))
+
+	status := fiber.StatusCreated
+	switch {
+	case report.Rejected == 0:
+	case report.Accepted > 0:
+		status = fiber.StatusMultiStatus
+	case bufferStatus != 0:
+		status = bufferStatus
+	case storageStatus != 0:
+		status = storageStatus
+	case forbidden == report.Rejected:
+		status = fiber.StatusForbidden
+	default:
+		status = fiber.StatusBadRequest
+	}
+	return c.Status(status).JSON(&report)
+}
+
+func (r *IngestReport) reject(i int, errors fiber.Map) {
+	r.Results[i].Status = StatusRejected
+	r.Results[i].Errors = errors
+	r.Rejected++
+}
+
+// splitItems - returns raw JSON of every measurement in request body
+func splitItems(c *fiber.Ctx) ([]json.RawMessage, error) {
+	body := c.Body()
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), ndjsonContentType) {
+		items := make([]json.RawMessage, 0, bytes.Count(body, []byte("\n"))+1)
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		scanner.Buffer(make([]byte, 0, 64*1024), maxNDJSONLineSize)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			items = append(items, json.RawMessage(append([]byte(nil), line...)))
+		}
+		return items, scanner.Err()
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
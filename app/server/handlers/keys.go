@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	"github.com/qwlt/gmcollector/app/models"
+)
+
+type CreateKeyValidator struct {
+	Name        string      `json:"name" validate:"required"`
+	Scopes      []string    `json:"scopes" validate:"required,min=1"`
+	DeviceIDs   []uuid.UUID `json:"deviceIds"`
+	DeviceGroup *string     `json:"deviceGroup"`
+	ExpiresAt   *time.Time  `json:"expiresAt"`
+}
+
+type GroupValidator struct {
+	DeviceIDs []uuid.UUID `json:"deviceIds"`
+}
+
+func keyError(c *fiber.Ctx, err error) error {
+	switch err {
+	case apikeys.ErrKeyNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(&fiber.Map{"errors": err.Error()})
+	case apikeys.ErrUnknownScope:
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
+	}
+	log.Println(err)
+	return c.Status(fiber.StatusInternalServerError).JSON(&fiber.Map{"errors": err.Error()})
+}
+
+func keyID(c *fiber.Ctx) (uuid.UUID, error) {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return uuid.Nil, apikeys.ErrKeyNotFound
+	}
+	return id, nil
+}
+
+// CreateKeyHandler - creates API key, token is returned only once
+func CreateKeyHandler(c *fiber.Ctx) error {
+	kv := CreateKeyValidator{}
+	if err := c.BodyParser(&kv); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
+	}
+	if err := models.ValidateStruct(&kv); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
+	}
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return keyError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	key, token, err := store.Create(ctx, kv.Name, kv.Scopes, kv.DeviceIDs, kv.DeviceGroup, kv.ExpiresAt)
+	if err != nil {
+		return keyError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(&fiber.Map{"key": key, "token": token})
+}
+
+func ListKeysHandler(c *fiber.Ctx) error {
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return keyError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, err := store.List(ctx)
+	if err != nil {
+		return keyError(c, err)
+	}
+	return c.JSON(&fiber.Map{"keys": keys})
+}
+
+// RotateKeyHandler - issues new token for key, old token stops working
+func RotateKeyHandler(c *fiber.Ctx) error {
+	id, err := keyID(c)
+	if err != nil {
+		return keyError(c, err)
+	}
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return keyError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	token, err := store.Rotate(ctx, id)
+	if err != nil {
+		return keyError(c, err)
+	}
+	return c.JSON(&fiber.Map{"id": id, "token": token})
+}
+
+func RevokeKeyHandler(c *fiber.Ctx) error {
+	id, err := keyID(c)
+	if err != nil {
+		return keyError(c, err)
+	}
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return keyError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := store.Revoke(ctx, id); err != nil {
+		return keyError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func ListGroupsHandler(c *fiber.Ctx) error {
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return keyError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	groups, err := store.Groups(ctx)
+	if err != nil {
+		return keyError(c, err)
+	}
+	return c.JSON(&fiber.Map{"groups": groups})
+}
+
+// SetGroupHandler - replaces members of device group, keys bound to group are updated immediately
+func SetGroupHandler(c *fiber.Ctx) error {
+	gv := GroupValidator{}
+	if err := c.BodyParser(&gv); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": err.Error()})
+	}
+	store, err := apikeys.GetStore()
+	if err != nil {
+		return keyError(c, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := store.SetGroup(ctx, c.Params("name"), gv.DeviceIDs); err != nil {
+		return keyError(c, err)
+	}
+	return c.JSON(&fiber.Map{"name": c.Params("name"), "deviceIds": gv.DeviceIDs})
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+)
+
+const (
+	maxLatestIDs          = 1000
+	defaultStaleThreshold = time.Hour
+)
+
+func latestCache(c *fiber.Ctx) (*buff.LatestCache, error) {
+	b, err := buff.GetBuffer()
+	if err != nil {
+		return nil, c.Status(fiber.StatusServiceUnavailable).JSON(&fiber.Map{"errors": err.Error()})
+	}
+	return b.Latest(), nil
+}
+
+// LatestHandler - returns last value reported by device
+func LatestHandler(c *fiber.Ctx) error {
+	id, ok, err := deviceParam(c)
+	if !ok {
+		return err
+	}
+	cache, err := latestCache(c)
+	if cache == nil {
+		return err
+	}
+	v, ok := cache.Get(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(&fiber.Map{"errors": "device has not reported any value"})
+	}
+	return c.JSON(&v)
+}
+
+// LatestManyHandler - returns last values of devices listed in `ids` separated by comma
+func LatestManyHandler(c *fiber.Ctx) error {
+	raw := strings.Split(c.Query("ids"), ",")
+	ids := make([]uuid.UUID, 0, len(raw))
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": fiber.Map{"ids": "invalid device id `" + s + "`"}})
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 || len(ids) > maxLatestIDs {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": fiber.Map{"ids": "must contain from 1 to " + strconv.Itoa(maxLatestIDs) + " device ids"}})
+	}
+	if p := apikeys.FromContext(c); p != nil {
+		for _, id := range ids {
+			if !p.CanAccessDevice(id) {
+				return c.Status(fiber.StatusForbidden).JSON(&fiber.Map{"errors": "API key is not allowed to read data of device " + id.String()})
+			}
+		}
+	}
+	cache, err := latestCache(c)
+	if cache == nil {
+		return err
+	}
+	found, missing := cache.GetMany(ids)
+	return c.JSON(&fiber.Map{"data": found, "missing": missing})
+}
+
+// StaleDevicesHandler - lists devices silent longer than `threshold`, defaults to 1h,
+// API keys bound to devices see only their own devices
+func StaleDevicesHandler(c *fiber.Ctx) error {
+	threshold := defaultStaleThreshold
+	if s := c.Query("threshold"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": fiber.Map{"threshold": "must be positive duration, e.g. 15m"}})
+		}
+		threshold = d
+	}
+	cache, err := latestCache(c)
+	if cache == nil {
+		return err
+	}
+	stale := cache.Stale(threshold, time.Now())
+	if p := apikeys.FromContext(c); p != nil {
+		visible := stale[:0]
+		for _, v := range stale {
+			if p.CanAccessDevice(v.DeviceID) {
+				visible = append(visible, v)
+			}
+		}
+		stale = visible
+	}
+	return c.JSON(&fiber.Map{"threshold": threshold.String(), "data": stale})
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	"github.com/qwlt/gmcollector/app/query"
+)
+
+const (
+	defaultReadLimit = 100
+	maxReadLimit     = 1000
+	defaultReadRange = 24 * time.Hour
+)
+
+// deviceParam - parses device id from path and checks that principal may read it,
+// returns false if error response was already sent
+func deviceParam(c *fiber.Ctx) (uuid.UUID, bool, error) {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return uuid.Nil, false, c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": fiber.Map{"id": "invalid device id"}})
+	}
+	if p := apikeys.FromContext(c); p != nil && !p.CanAccessDevice(id) {
+		return uuid.Nil, false, c.Status(fiber.StatusForbidden).JSON(&fiber.Map{"errors": "API key is not allowed to read data of this device"})
+	}
+	return id, true, nil
+}
+
+// parseTimeRange - reads `from` and `to` query params, `to` defaults to now and `from` to 24h before `to`
+func parseTimeRange(c *fiber.Ctx) (time.Time, time.Time, fiber.Map) {
+	errors := fiber.Map{}
+	to := time.Now().UTC()
+	if s := c.Query("to"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			errors["to"] = "must be RFC3339 timestamp"
+		}
+		to = t
+	}
+	from := to.Add(-defaultReadRange)
+	if s := c.Query("from"); s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			errors["from"] = "must be RFC3339 timestamp"
+		}
+		from = t
+	}
+	if len(errors) == 0 && !from.Before(to) {
+		errors["from"] = "must be before `to`"
+	}
+	if len(errors) > 0 {
+		return from, to, errors
+	}
+	return from, to, nil
+}
+
+// parseRangeQuery - builds query from request params or returns map of param errors
+func parseRangeQuery(c *fiber.Ctx, id uuid.UUID) (query.RangeQuery, fiber.Map) {
+	q := query.RangeQuery{DeviceID: id, Limit: defaultReadLimit}
+	from, to, errors := parseTimeRange(c)
+	if errors == nil {
+		errors = fiber.Map{}
+	}
+	q.From, q.To = from, to
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxReadLimit {
+			errors["limit"] = "must be integer from 1 to " + strconv.Itoa(maxReadLimit)
+		}
+		q.Limit = limit
+	}
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := query.DecodeCursor(s)
+		if err != nil {
+			errors["cursor"] = err.Error()
+		}
+		q.After = cursor
+	}
+	if len(errors) > 0 {
+		return q, errors
+	}
+	return q, nil
+}
+
+// ReadMeasurementsHandler - returns page of device measurements in time range ordered by time
+func ReadMeasurementsHandler(c *fiber.Ctx) error {
+	id, ok, err := deviceParam(c)
+	if !ok {
+		return err
+	}
+	q, errors := parseRangeQuery(c, id)
+	if errors != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": errors})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	points, next, err := query.GetReader().Measurements(ctx, q)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(&fiber.Map{"errors": "cant read measurements"})
+	}
+	response := fiber.Map{"data": points, "nextCursor": nil}
+	if next != nil {
+		response["nextCursor"] = next.Encode()
+	}
+	return c.JSON(&response)
+}
+
+// AggregateHandler - returns device values aggregated per bucket, gaps are filled according to `fill`
+func AggregateHandler(c *fiber.Ctx) error {
+	id, ok, err := deviceParam(c)
+	if !ok {
+		return err
+	}
+	from, to, errors := parseTimeRange(c)
+	if errors == nil {
+		errors = fiber.Map{}
+	}
+	q := query.AggregateQuery{
+		DeviceID: id,
+		Function: c.Query("fn", "avg"),
+		From:     from,
+		To:       to,
+		Fill:     c.Query("fill", query.FillNull),
+	}
+	bucket, err := query.ParseBucket(c.Query("bucket", "1h"))
+	if err != nil {
+		errors["bucket"] = err.Error()
+	}
+	q.Bucket = bucket
+	if len(errors) == 0 {
+		switch err := q.Validate(); err {
+		case nil:
+		case query.ErrUnknownFunction:
+			errors["fn"] = err.Error()
+		case query.ErrUnknownFill:
+			errors["fill"] = err.Error()
+		default:
+			errors["bucket"] = err.Error()
+		}
+	}
+	if len(errors) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": errors})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	buckets, err := query.GetReader().Aggregate(ctx, q)
+	if err != nil {
+		log.Println(err)
+		return c.Status(fiber.StatusInternalServerError).JSON(&fiber.Map{"errors": "cant aggregate measurements"})
+	}
+	return c.JSON(&fiber.Map{
+		"fn":     q.Function,
+		"bucket": q.Bucket.String(),
+		"fill":   q.Fill,
+		"data":   buckets,
+	})
+}
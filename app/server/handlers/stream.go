@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	"github.com/qwlt/gmcollector/app/stream"
+)
+
+const streamFilterKey = "streamFilter"
+
+// streamFilter - builds filter of devices listed in `device` query param separated by comma,
+// without devices stream contains every device principal may read
+func streamFilter(c *fiber.Ctx) (func(uuid.UUID) bool, error) {
+	p := apikeys.FromContext(c)
+	devices := make(map[uuid.UUID]struct{})
+	for _, s := range strings.Split(c.Query("device"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, err := uuid.Parse(s)
+		if err != nil {
+			return nil, c.Status(fiber.StatusBadRequest).JSON(&fiber.Map{"errors": fiber.Map{"device": "invalid device id `" + s + "`"}})
+		}
+		if p != nil && !p.CanAccessDevice(id) {
+			return nil, c.Status(fiber.StatusForbidden).JSON(&fiber.Map{"errors": "API key is not allowed to read data of device " + id.String()})
+		}
+		devices[id] = struct{}{}
+	}
+	if len(devices) > 0 {
+		return func(id uuid.UUID) bool {
+			_, ok := devices[id]
+			return ok
+		}, nil
+	}
+	if p != nil {
+		return p.CanAccessDevice, nil
+	}
+	return func(uuid.UUID) bool { return true }, nil
+}
+
+// StreamHandler - streams accepted measurements as Server-Sent Events,
+// heartbeat reports number of events dropped for this client since connection
+func StreamHandler(c *fiber.Ctx) error {
+	filter, err := streamFilter(c)
+	if filter == nil {
+		return err
+	}
+	hub := stream.GetHub()
+	sub := hub.Subscribe(filter)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer hub.Unsubscribe(sub)
+		ticker := time.NewTicker(hub.Heartbeat())
+		defer ticker.Stop()
+		var reported uint64
+		for {
+			select {
+			case <-hub.Done():
+				return
+			case e := <-sub.C:
+				raw, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: measurement\ndata: %s\n\n", raw)
+			case <-ticker.C:
+				if dropped := sub.Dropped(); dropped != reported {
+					reported = dropped
+					fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%v}\n\n", dropped)
+				} else {
+					fmt.Fprint(w, ": ping\n\n")
+				}
+			}
+			// flush fails once client disconnects
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// StreamUpgradeHandler - checks websocket upgrade request and resolves device filter,
+// must precede StreamWebSocketHandler
+func StreamUpgradeHandler(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return c.Status(fiber.StatusUpgradeRequired).JSON(&fiber.Map{"errors": "websocket upgrade required"})
+	}
+	filter, err := streamFilter(c)
+	if filter == nil {
+		return err
+	}
+	c.Locals(streamFilterKey, filter)
+	return c.Next()
+}
+
+// StreamWebSocketHandler - streams accepted measurements as JSON text messages,
+// heartbeat is sent as ping, number of dropped events is sent as {"dropped": n}
+var StreamWebSocketHandler = websocket.New(func(conn *websocket.Conn) {
+	filter, _ := conn.Locals(streamFilterKey).(func(uuid.UUID) bool)
+	hub := stream.GetHub()
+	sub := hub.Subscribe(filter)
+	defer hub.Unsubscribe(sub)
+
+	// reading is needed to process control frames and notice closed connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(hub.Heartbeat())
+	defer ticker.Stop()
+	var reported uint64
+	for {
+		var err error
+		select {
+		case <-hub.Done():
+			_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"))
+			return
+		case <-closed:
+			return
+		case e := <-sub.C:
+			err = conn.WriteJSON(e)
+		case <-ticker.C:
+			if dropped := sub.Dropped(); dropped != reported {
+				reported = dropped
+				err = conn.WriteJSON(fiber.Map{"dropped": dropped})
+			} else {
+				err = conn.WriteMessage(websocket.PingMessage, nil)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+})
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/qwlt/gmcollector/app/apikeys"
+	buff "github.com/qwlt/gmcollector/app/writebuffer"
+)
+
+const (
+	// HeaderPrefer - `Prefer: sync` asks to respond only after datapoints are committed
+	HeaderPrefer            = "Prefer"
+	HeaderPreferenceApplied = "Preference-Applied"
+	preferSync              = "sync"
+)
+
+// writeThrough - reports whether request should be acknowledged only after its datapoints
+// are committed, requested by `Prefer: sync` header or by sync scope of API key
+func writeThrough(c *fiber.Ctx) bool {
+	for _, pref := range strings.Split(c.Get(HeaderPrefer), ",") {
+		token := strings.TrimSpace(strings.SplitN(strings.SplitN(pref, ";", 2)[0], "=", 2)[0])
+		if strings.EqualFold(token, preferSync) {
+			c.Set(HeaderPreferenceApplied, preferSync)
+			return true
+		}
+	}
+	p := apikeys.FromContext(c)
+	return p != nil && p.WriteThrough()
+}
+
+// ackErrorStatus - maps failed acknowledgement to response status: datapoint rejected by
+// storage because of its content gets 422, not committed in time 504, not written at all 5xx
+func ackErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, buff.ErrAckTimeout):
+		return fiber.StatusGatewayTimeout
+	case buff.IsRowError(err):
+		return fiber.StatusUnprocessableEntity
+	case errors.Is(err, buff.ErrNotWritten):
+		return fiber.StatusServiceUnavailable
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
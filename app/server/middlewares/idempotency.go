@@ -0,0 +1,127 @@
+package middlewares
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	HeaderReplayed       = "Idempotent-Replayed"
+	maxIdempotencyKeyLen = 255
+)
+
+type IdempotencyConfig struct {
+	// TTL of stored responses.
+	// Optional. Default: 24h
+	TTL time.Duration `mapstructure:"ttl"`
+
+	// MaxEntries limits number of stored responses, oldest are evicted first.
+	// Optional. Default: 100000
+	MaxEntries int `mapstructure:"maxEntries"`
+}
+
+type idempotentResponse struct {
+	status      int
+	contentType []byte
+	body        []byte
+	expires     time.Time
+	done        bool
+}
+
+type idempotencyStore struct {
+	mu      sync.Mutex
+	conf    IdempotencyConfig
+	entries map[[sha256.Size]byte]*idempotentResponse
+	order   []queued
+}
+
+type queued struct {
+	id    [sha256.Size]byte
+	entry *idempotentResponse
+}
+
+// NewIdempotency - replays stored response of request repeated with the same Idempotency-Key header,
+// keys are scoped by Authorization header, so clients can't see responses of each other.
+// Concurrent request with key still in progress gets 409, server errors and responses asking to retry
+// later (429 or any with Retry-After, like 207 with items rejected by overloaded buffer) are not stored
+func NewIdempotency(conf IdempotencyConfig) fiber.Handler {
+	if conf.TTL <= 0 {
+		conf.TTL = 24 * time.Hour
+	}
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = 100000
+	}
+	store := &idempotencyStore{conf: conf, entries: make(map[[sha256.Size]byte]*idempotentResponse)}
+
+	return func(c *fiber.Ctx) error {
+		key := c.Get(HeaderIdempotencyKey)
+		if key == "" {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"errors": fiber.Map{HeaderIdempotencyKey: "too long"}})
+		}
+		id := sha256.Sum256([]byte(c.Get(fiber.HeaderAuthorization) + "\x00" + c.Path() + "\x00" + key))
+
+		now := time.Now()
+		store.mu.Lock()
+		if r, ok := store.entries[id]; ok && now.Before(r.expires) {
+			store.mu.Unlock()
+			if !r.done {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{"errors": "request with the same " + HeaderIdempotencyKey + " is in progress"})
+			}
+			c.Set(HeaderReplayed, "true")
+			c.Response().Header.SetContentTypeBytes(r.contentType)
+			return c.Status(r.status).Send(r.body)
+		}
+		entry := &idempotentResponse{expires: now.Add(conf.TTL)}
+		store.put(id, entry)
+		store.mu.Unlock()
+
+		err := c.Next()
+
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		status := c.Response().StatusCode()
+		if err != nil || !storable(c, status) {
+			if store.entries[id] == entry {
+				delete(store.entries, id)
+			}
+			return err
+		}
+		entry.status = status
+		entry.contentType = append([]byte(nil), c.Response().Header.ContentType()...)
+		entry.body = append([]byte(nil), c.Response().Body()...)
+		entry.done = true
+		return nil
+	}
+}
+
+// storable - reports whether response is final, retried request would get stored one otherwise
+func storable(c *fiber.Ctx, status int) bool {
+	return status < fiber.StatusInternalServerError && status != fiber.StatusTooManyRequests &&
+		len(c.Response().Header.Peek(fiber.HeaderRetryAfter)) == 0
+}
+
+// put - stores entry evicting expired and, if store is full, oldest ones; must be called under lock.
+// All entries have the same TTL, so insertion order is expiration order
+func (s *idempotencyStore) put(id [sha256.Size]byte, entry *idempotentResponse) {
+	now := time.Now()
+	for len(s.order) > 0 {
+		front := s.order[0]
+		if now.Before(front.entry.expires) && len(s.entries) < s.conf.MaxEntries {
+			break
+		}
+		// entry may have been replaced or removed already
+		if s.entries[front.id] == front.entry {
+			delete(s.entries, front.id)
+		}
+		s.order = s.order[1:]
+	}
+	s.entries[id] = entry
+	s.order = append(s.order, queued{id: id, entry: entry})
+}
@@ -0,0 +1,78 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	calls := 0
+	app := fiber.New(fiber.Config{JSONEncoder: json.Marshal, JSONDecoder: json.Unmarshal})
+	app.Post("/ingest", NewIdempotency(IdempotencyConfig{}), func(c *fiber.Ctx) error {
+		calls++
+		if c.Query("fail") != "" {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("busy")
+		}
+		switch c.Query("overload") {
+		case "shed":
+			return c.Status(fiber.StatusTooManyRequests).SendString("shed")
+		case "partial":
+			c.Set(fiber.HeaderRetryAfter, "1")
+			return c.Status(fiber.StatusMultiStatus).JSON(fiber.Map{"call": calls})
+		}
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"call": calls})
+	})
+	do := func(path, key, auth string) (int, string, string) {
+		req := httptest.NewRequest("POST", path, nil)
+		if key != "" {
+			req.Header.Set(HeaderIdempotencyKey, key)
+		}
+		req.Header.Set(fiber.HeaderAuthorization, auth)
+		resp, err := app.Test(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body), resp.Header.Get(HeaderReplayed)
+	}
+
+	status, body, replayed := do("/ingest", "k1", "Bearer a")
+	require.Equal(t, fiber.StatusCreated, status)
+	require.Equal(t, `{"call":1}`, body)
+	require.Empty(t, replayed)
+
+	status, body, replayed = do("/ingest", "k1", "Bearer a")
+	require.Equal(t, fiber.StatusCreated, status)
+	require.Equal(t, `{"call":1}`, body)
+	require.Equal(t, "true", replayed)
+
+	// other client and requests without key are processed
+	_, body, _ = do("/ingest", "k1", "Bearer b")
+	require.Equal(t, `{"call":2}`, body)
+	_, body, _ = do("/ingest", "", "Bearer a")
+	require.Equal(t, `{"call":3}`, body)
+
+	// server errors are not stored
+	status, _, _ = do("/ingest?fail=1", "k2", "Bearer a")
+	require.Equal(t, fiber.StatusServiceUnavailable, status)
+	status, _, _ = do("/ingest", "k2", "Bearer a")
+	require.Equal(t, fiber.StatusCreated, status)
+	require.Equal(t, 5, calls)
+
+	// responses asking to retry later are not stored either
+	status, _, _ = do("/ingest?overload=shed", "k3", "Bearer a")
+	require.Equal(t, fiber.StatusTooManyRequests, status)
+	status, _, replayed = do("/ingest", "k3", "Bearer a")
+	require.Equal(t, fiber.StatusCreated, status)
+	require.Empty(t, replayed)
+	status, _, _ = do("/ingest?overload=partial", "k4", "Bearer a")
+	require.Equal(t, fiber.StatusMultiStatus, status)
+	status, _, replayed = do("/ingest", "k4", "Bearer a")
+	require.Equal(t, fiber.StatusCreated, status)
+	require.Empty(t, replayed)
+	require.Equal(t, 9, calls)
+}
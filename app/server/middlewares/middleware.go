@@ -29,10 +29,16 @@ type Config struct {
 	// Optional. Default: nil
 	Validator func(*fiber.Ctx, string) (bool, error)
 
+	// Resolver resolves key into principal which is stored under ContextKey
+	// instead of the key itself, key is valid if Resolver returns no error.
+	// Used instead of Validator when set.
+	// Optional. Default: nil
+	Resolver func(*fiber.Ctx, string) (interface{}, error)
+
 	// AuthScheme determine which http authentication scheme to use
 	AuthScheme string
 
-	// Context key to store the bearertoken from the token into context.
+	// Context key to store the bearertoken or resolved principal into context.
 	// Optional. Default: "token".
 	ContextKey string
 
@@ -74,7 +80,7 @@ func New(config ...Config) fiber.Handler {
 		cfg.ContextKey = "token"
 	}
 	if cfg.KeyExtractor == nil {
-		cfg.KeyExtractor = ExtractFromHeader("Basic")
+		cfg.KeyExtractor = ExtractFromHeader(cfg.AuthScheme)
 	}
 
 	// Return middleware handler
@@ -86,13 +92,19 @@ func New(config ...Config) fiber.Handler {
 
 		apiKey, err := cfg.KeyExtractor(c)
 		if err != nil {
-			cfg.ErrorHandler(c, err)
+			return cfg.ErrorHandler(c, err)
 		}
 
-		valid, err := cfg.Validator(c, apiKey)
-		if err != nil {
-			cfg.ErrorHandler(c, err)
+		if cfg.Resolver != nil {
+			principal, err := cfg.Resolver(c, apiKey)
+			if err != nil {
+				return cfg.ErrorHandler(c, err)
+			}
+			c.Locals(cfg.ContextKey, principal)
+			return cfg.SuccessHandler(c)
 		}
+
+		valid, err := cfg.Validator(c, apiKey)
 		if err == nil && valid {
 
 			c.Locals(cfg.ContextKey, apiKey)
@@ -108,8 +120,8 @@ func ExtractFromHeader(authScheme string) func(c *fiber.Ctx) (string, error) {
 		if header == "" {
 			return "", errMissingOrMalformedAPIKey
 		}
-		s := strings.Split(header, " ")
-		if len(s) > 1 {
+		s := strings.Fields(header)
+		if len(s) == 2 && strings.EqualFold(s[0], authScheme) {
 			return s[1], nil
 		}
 		return "", errMissingOrMalformedAPIKey
@@ -119,3 +131,15 @@ func ExtractFromHeader(authScheme string) func(c *fiber.Ctx) (string, error) {
 func AlwaysPassFilter(ctx *fiber.Ctx) bool {
 	return true
 }
+
+// PathFilter - skips middleware for requests to given paths
+func PathFilter(paths ...string) func(*fiber.Ctx) bool {
+	return func(ctx *fiber.Ctx) bool {
+		for _, p := range paths {
+			if ctx.Path() == p {
+				return true
+			}
+		}
+		return false
+	}
+}
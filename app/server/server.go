@@ -1,10 +1,14 @@
 package server
 
 import (
+	"encoding/json"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/qwlt/gmcollector/app/apikeys"
 	cfg "github.com/qwlt/gmcollector/app/config"
+	"github.com/qwlt/gmcollector/app/metrics"
+	"github.com/qwlt/gmcollector/app/models"
 	"github.com/qwlt/gmcollector/app/server/handlers"
 	"github.com/qwlt/gmcollector/app/server/middlewares"
 	"github.com/spf13/viper"
@@ -25,10 +29,16 @@ func NewServer() *fiber.App {
 		fiber.Config{
 			AppName:     "Data collector",
 			Concurrency: conf.MaxConnections,
+			// bundled go-json encoder crashes on maps with recent Go runtimes
+			JSONEncoder: json.Marshal,
+			JSONDecoder: json.Unmarshal,
 		},
 	)
-	handlers.InitValidator()
-	SetupRoutes(server)
+	models.InitValidator(conf.Metadata)
+	handlers.InitHealth(conf.Health)
+	if err := SetupRoutes(server); err != nil {
+		log.Fatal(err)
+	}
 	return server
 }
 
@@ -37,19 +47,74 @@ type ServerConfig struct {
 	Port           string `mapstruct:"port"`
 	MaxConnections int    `mapstruct:"maxConnections"`
 	BodyLimit      int    `mapstruct:"maxBodySize"`
+
+	Metadata models.MetadataLimits `mapstructure:"metadata"`
+	Health   handlers.HealthConfig `mapstructure:"health"`
 }
 
+// publicPaths - routes which are available without API key
+var publicPaths = []string{"/", "/healthz", "/readyz", "/metrics"}
+
 func SetupRoutes(app *fiber.App) error {
-	// TODO remove always pass filter before build
-	app.Use(
-		middlewares.New(
-			middlewares.Config{
-				Filter: middlewares.AlwaysPassFilter,
-			},
-		),
-	)
+	authConf := apikeys.Config{}
+	if viper.IsSet("auth") {
+		if err := viper.UnmarshalKey("auth", &authConf); err != nil {
+			return err
+		}
+	}
+	if authConf.Enabled {
+		store, err := apikeys.GetStore()
+		if err != nil {
+			return err
+		}
+		app.Use(
+			middlewares.New(
+				middlewares.Config{
+					Filter:     middlewares.PathFilter(publicPaths...),
+					Resolver:   store.Resolver,
+					ContextKey: apikeys.ContextKey,
+				},
+			),
+		)
+	} else {
+		log.Println("Authentication is disabled, all requests are allowed")
+	}
+	idempotencyConf := middlewares.IdempotencyConfig{}
+	if viper.IsSet("server.idempotency") {
+		if err := viper.UnmarshalKey("server.idempotency", &idempotencyConf); err != nil {
+			return err
+		}
+	}
+	// shared by ingestion routes, keys are scoped by path
+	idempotency := middlewares.NewIdempotency(idempotencyConf)
+
 	app.Add("get", "/", handlers.MainHandler)
-	app.Add("post", "/test", handlers.TestHandler)
+	app.Get("/metrics", metrics.Handler())
+	app.Get("/healthz", handlers.LivenessHandler)
+	app.Get("/readyz", handlers.ReadinessHandler)
+	app.Add("post", "/test", apikeys.RequireScope(apikeys.ScopeWrite), idempotency, handlers.TestHandler)
+
+	v1 := app.Group("/v1")
+	v1.Post("/measurements", apikeys.RequireScope(apikeys.ScopeWrite), idempotency, handlers.IngestMeasurementsHandler)
+	v1.Get("/devices/:id/measurements", apikeys.RequireScope(apikeys.ScopeRead), handlers.ReadMeasurementsHandler)
+	v1.Get("/devices/:id/aggregate", apikeys.RequireScope(apikeys.ScopeRead), handlers.AggregateHandler)
+	v1.Get("/devices/:id/latest", apikeys.RequireScope(apikeys.ScopeRead), handlers.LatestHandler)
+	v1.Get("/latest", apikeys.RequireScope(apikeys.ScopeRead), handlers.LatestManyHandler)
+	v1.Get("/latest/stale", apikeys.RequireScope(apikeys.ScopeRead), handlers.StaleDevicesHandler)
+	v1.Get("/stream", apikeys.RequireScope(apikeys.ScopeRead), handlers.StreamHandler)
+	v1.Get("/stream/ws", apikeys.RequireScope(apikeys.ScopeRead), handlers.StreamUpgradeHandler, handlers.StreamWebSocketHandler)
+
+	admin := app.Group("/admin", apikeys.RequireScope(apikeys.ScopeAdmin))
+	admin.Get("/deadletter", handlers.ListDeadLetterHandler)
+	admin.Get("/deadletter/:id", handlers.GetDeadLetterHandler)
+	admin.Post("/deadletter/:id/replay", handlers.ReplayDeadLetterHandler)
+	admin.Delete("/deadletter/:id", handlers.DeleteDeadLetterHandler)
+	admin.Get("/keys", handlers.ListKeysHandler)
+	admin.Post("/keys", handlers.CreateKeyHandler)
+	admin.Post("/keys/:id/rotate", handlers.RotateKeyHandler)
+	admin.Delete("/keys/:id", handlers.RevokeKeyHandler)
+	admin.Get("/groups", handlers.ListGroupsHandler)
+	admin.Put("/groups/:name", handlers.SetGroupHandler)
 	// app.Add("post", "/test", handlers.AnotherHandler)
 	return nil
 }
@@ -0,0 +1,149 @@
+package stream
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/metrics"
+	m "github.com/qwlt/gmcollector/app/models"
+	"github.com/spf13/viper"
+)
+
+var H *Hub
+
+// Config - live stream settings, read from `stream` section
+// QueueSize - max number of events waiting for a slow subscriber, newer events are dropped
+// Heartbeat - period of keep-alive messages which also detect disconnected clients
+type Config struct {
+	QueueSize int           `mapstructure:"queueSize"`
+	Heartbeat time.Duration `mapstructure:"heartbeat"`
+}
+
+// Event - measurement as sent to stream subscribers
+type Event struct {
+	DeviceID  uuid.UUID              `json:"id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// Hub - fans accepted datapoints out to subscribers, publishing never blocks:
+// events which don't fit into subscriber queue are dropped and counted
+type Hub struct {
+	mu        sync.RWMutex
+	subs      map[*Subscription]struct{}
+	conf      Config
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Subscription - bounded queue of events of devices accepted by filter
+type Subscription struct {
+	C       chan Event
+	filter  func(uuid.UUID) bool
+	dropped uint64
+}
+
+func NewHub(conf Config) *Hub {
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = 256
+	}
+	if conf.Heartbeat <= 0 {
+		conf.Heartbeat = 15 * time.Second
+	}
+	return &Hub{subs: make(map[*Subscription]struct{}), conf: conf, done: make(chan struct{})}
+}
+
+// GetHub - returns hub shared by ingestion and stream endpoints
+func GetHub() *Hub {
+	if H == nil {
+		conf := Config{}
+		if viper.IsSet("stream") {
+			if err := viper.UnmarshalKey("stream", &conf); err != nil {
+				log.Fatal(err)
+			}
+		}
+		H = NewHub(conf)
+	}
+	return H
+}
+
+func (h *Hub) Heartbeat() time.Duration {
+	return h.conf.Heartbeat
+}
+
+// Done - closed when hub is closed, subscribers must disconnect then
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Close - tells subscribers to disconnect, so server shutdown isn't held by open streams
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+// Subscribe - registers subscriber receiving events of devices accepted by filter,
+// nil filter accepts every device
+func (h *Hub) Subscribe(filter func(uuid.UUID) bool) *Subscription {
+	s := &Subscription{C: make(chan Event, h.conf.QueueSize), filter: filter}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	metrics.StreamSubscribers.Inc()
+	return s
+}
+
+// Unsubscribe - removes subscriber, its queue is not closed as publisher may still hold it
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	_, ok := h.subs[s]
+	delete(h.subs, s)
+	h.mu.Unlock()
+	if ok {
+		metrics.StreamSubscribers.Dec()
+	}
+}
+
+func (h *Hub) Subscribers() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+// Observe - publishes accepted datapoint, implementation of writebuffer.Observer
+func (h *Hub) Observe(datapoint m.Model) {
+	v, ok := m.AsMeasurement(datapoint)
+	if !ok {
+		return
+	}
+	h.Publish(v)
+}
+
+// Publish - puts measurement into queues of interested subscribers without waiting
+func (h *Hub) Publish(v m.Measurement) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	e := Event{DeviceID: v.DeviceID, Timestamp: v.Timestamp, Value: v.Value, Metadata: v.Metadata}
+	for s := range h.subs {
+		if s.filter != nil && !s.filter(v.DeviceID) {
+			continue
+		}
+		select {
+		case s.C <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			metrics.StreamDropped.Inc()
+		}
+	}
+}
+
+// Dropped - number of events dropped because subscriber queue was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
@@ -0,0 +1,50 @@
+package stream
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishFiltersAndDropsWithoutBlocking(t *testing.T) {
+	hub := NewHub(Config{QueueSize: 2})
+	device := uuid.New()
+	all := hub.Subscribe(nil)
+	one := hub.Subscribe(func(id uuid.UUID) bool { return id == device })
+	defer hub.Unsubscribe(all)
+	defer hub.Unsubscribe(one)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 5; i++ {
+			hub.Observe(models.Measurement{DeviceID: uuid.New(), Value: float64(i)})
+		}
+		hub.Observe(&models.Measurement{DeviceID: device, Value: 42})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publish blocked on full subscriber queue")
+	}
+
+	require.Len(t, all.C, 2)
+	require.Equal(t, uint64(4), all.Dropped())
+	require.Len(t, one.C, 1)
+	require.Equal(t, 42.0, (<-one.C).Value)
+	require.Equal(t, uint64(0), one.Dropped())
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := NewHub(Config{})
+	s := hub.Subscribe(nil)
+	require.Equal(t, 1, hub.Subscribers())
+	hub.Unsubscribe(s)
+	hub.Unsubscribe(s)
+	require.Equal(t, 0, hub.Subscribers())
+	hub.Publish(models.Measurement{})
+	require.Len(t, s.C, 0)
+}
@@ -0,0 +1,459 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qwlt/gmcollector/app/models"
+)
+
+const (
+	segmentExt  = ".wal"
+	markerExt   = ".commit"
+	headerSize  = 8
+	maxRecordSz = 16 << 20
+
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNone     = "none"
+)
+
+var ErrUnsupportedModel = errors.New("wal: unsupported model type")
+
+// Config - write-ahead log settings, read from `pool.wal` section
+// Dir - directory which holds segment files
+// SegmentSize - max size of a single segment file in bytes before rotation
+// Fsync - fsync policy: always (every append), interval or none
+// FsyncInterval - period between fsyncs when Fsync is `interval`
+type Config struct {
+	Enabled       bool          `mapstructure:"enabled"`
+	Dir           string        `mapstructure:"dir"`
+	SegmentSize   int64         `mapstructure:"segmentSize"`
+	Fsync         string        `mapstructure:"fsync"`
+	FsyncInterval time.Duration `mapstructure:"fsyncInterval"`
+}
+
+// segment - committed count of sealed and active segments is persisted in marker file
+// next to segment, so records committed before crash are not replayed again
+type segment struct {
+	id        uint64
+	path      string
+	records   int
+	committed int
+}
+
+// WAL - segmented append-only log of accepted datapoints.
+// Records are committed in the same order they were appended, so caller must
+// guarantee that order of appends matches the order datapoints are persisted
+type WAL struct {
+	mu         sync.Mutex
+	conf       Config
+	recovered  []*segment
+	segments   []*segment
+	active     *segment
+	file       *os.File
+	size       int64
+	lastOffset int64
+	dirty      bool
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+}
+
+// Open - creates directory if needed, remembers segments left from previous run
+// for Replay and starts a fresh active segment
+func Open(conf Config) (*WAL, error) {
+	if conf.Dir == "" {
+		conf.Dir = "wal"
+	}
+	if conf.SegmentSize <= 0 {
+		conf.SegmentSize = 64 << 20
+	}
+	if conf.Fsync == "" {
+		conf.Fsync = FsyncInterval
+	}
+	if conf.FsyncInterval <= 0 {
+		conf.FsyncInterval = time.Second
+	}
+	switch conf.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNone:
+	default:
+		return nil, fmt.Errorf("wal: unknown fsync policy `%v`", conf.Fsync)
+	}
+	if err := os.MkdirAll(conf.Dir, 0755); err != nil {
+		return nil, err
+	}
+	ids, err := listSegments(conf.Dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{conf: conf}
+	var nextID uint64 = 1
+	for _, id := range ids {
+		path := segmentPath(conf.Dir, id)
+		w.recovered = append(w.recovered, &segment{id: id, path: path, committed: readMarker(path)})
+		nextID = id + 1
+	}
+	if err := w.openSegment(nextID); err != nil {
+		return nil, err
+	}
+	if conf.Fsync == FsyncInterval {
+		w.stopChan = make(chan struct{})
+		w.doneChan = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// Append - encodes datapoint and writes it to the active segment
+func (w *WAL) Append(datapoint models.Model) error {
+	payload, err := encode(datapoint)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recordSize := int64(headerSize + len(payload))
+	if w.size > 0 && w.size+recordSize > w.conf.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	copy(buf[headerSize:], payload)
+	if _, err := w.file.Write(buf); err != nil {
+		return err
+	}
+	if w.conf.Fsync == FsyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		w.dirty = true
+	}
+	w.lastOffset = w.size
+	w.size += recordSize
+	w.active.records++
+	return nil
+}
+
+// Discard - removes the last appended record, used when datapoint
+// was logged but could not be accepted by the buffer
+func (w *WAL) Discard() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.active.records == w.active.committed || w.size == 0 {
+		return nil
+	}
+	if err := w.file.Truncate(w.lastOffset); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(w.lastOffset, io.SeekStart); err != nil {
+		return err
+	}
+	w.size = w.lastOffset
+	w.active.records--
+	return nil
+}
+
+// Commit - marks n oldest uncommitted records as persisted and
+// removes segments which don't hold uncommitted records anymore
+func (w *WAL) Commit(n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for n > 0 && len(w.segments) > 0 {
+		s := w.segments[0]
+		left := s.records - s.committed
+		if n < left {
+			s.committed += n
+			return w.writeMarker(s)
+		}
+		n -= left
+		if err := removeSegment(s.path); err != nil {
+			return err
+		}
+		w.segments = w.segments[1:]
+	}
+	if n == 0 {
+		return nil
+	}
+	w.active.committed += n
+	if w.active.committed > w.active.records {
+		w.active.committed = w.active.records
+	}
+	if w.active.committed == w.active.records {
+		return w.reset()
+	}
+	return w.writeMarker(w.active)
+}
+
+// Replay - reads segments left from previous run and passes their uncommitted datapoints
+// to fn in batches of batchSize, progress is persisted after every batch and segment is removed
+// as soon as all its records are handled, so failed replay resumes after the last handled batch
+func (w *WAL) Replay(batchSize int, fn func([]models.Model) error) (int, error) {
+	w.mu.Lock()
+	recovered := w.recovered
+	w.mu.Unlock()
+	if batchSize <= 0 {
+		batchSize = 1024
+	}
+	total := 0
+	for _, s := range recovered {
+		n, err := w.replaySegment(s, batchSize, fn)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if err := removeSegment(s.path); err != nil {
+			return total, err
+		}
+	}
+	w.mu.Lock()
+	w.recovered = nil
+	w.mu.Unlock()
+	return total, nil
+}
+
+func (w *WAL) replaySegment(s *segment, batchSize int, fn func([]models.Model) error) (int, error) {
+	total, skip := 0, s.committed
+	batch := make([]models.Model, 0, batchSize)
+	flush := func() error {
+		if err := fn(batch); err != nil {
+			return err
+		}
+		total += len(batch)
+		s.committed += len(batch)
+		batch = make([]models.Model, 0, batchSize)
+		return w.writeMarker(s)
+	}
+	err := readSegment(s.path, func(datapoint models.Model) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		batch = append(batch, datapoint)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	return total, err
+}
+
+// Close - flushes active segment to disk and stops background fsync
+func (w *WAL) Close() error {
+	if w.stopChan != nil {
+		close(w.stopChan)
+		<-w.doneChan
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *WAL) syncLoop() {
+	ticker := time.NewTicker(w.conf.FsyncInterval)
+	defer ticker.Stop()
+	defer close(w.doneChan)
+	for {
+		select {
+		case <-w.stopChan:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				if err := w.file.Sync(); err != nil {
+					log.Println(err)
+				}
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *WAL) openSegment(id uint64) error {
+	path := segmentPath(w.conf.Dir, id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// marker may be left by removed segment with the same id
+	if err := os.Remove(markerPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	w.file = f
+	w.active = &segment{id: id, path: path}
+	w.size = 0
+	w.lastOffset = 0
+	return nil
+}
+
+func (w *WAL) rotate() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.dirty = false
+	w.segments = append(w.segments, w.active)
+	return w.openSegment(w.active.id + 1)
+}
+
+// reset - truncates fully committed active segment instead of creating a new one
+func (w *WAL) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.active.records = 0
+	w.active.committed = 0
+	w.size = 0
+	w.lastOffset = 0
+	if err := os.Remove(markerPath(w.active.path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeMarker - replaces marker of segment atomically, lost marker only makes committed
+// records replayed again, so it's synced to disk with `always` fsync policy only
+func (w *WAL) writeMarker(s *segment) error {
+	path := markerPath(s.path)
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(s.committed))
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if w.conf.Fsync == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readMarker - number of committed records of segment, 0 if marker is missing or damaged
+func readMarker(segment string) int {
+	buf, err := os.ReadFile(markerPath(segment))
+	if err != nil || len(buf) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(buf))
+}
+
+func markerPath(segment string) string {
+	return segment + markerExt
+}
+
+// removeSegment - removes segment and then its marker, marker left by crash in between
+// is removed when segment id is used again
+func removeSegment(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(markerPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func encode(datapoint models.Model) ([]byte, error) {
+	v, ok := models.AsMeasurement(datapoint)
+	if !ok {
+		return nil, ErrUnsupportedModel
+	}
+	return json.Marshal(v)
+}
+
+// readSegment - decodes records one by one, stops silently on a torn or corrupted tail
+func readSegment(path string, fn func(models.Model) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > maxRecordSz {
+			log.Printf("wal: corrupted record length in %v, skipping the rest of segment", path)
+			return nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("wal: checksum mismatch in %v, skipping the rest of segment", path)
+			return nil
+		}
+		var datapoint models.Measurement
+		if err := json.Unmarshal(payload, &datapoint); err != nil {
+			return err
+		}
+		if err := fn(datapoint); err != nil {
+			return err
+		}
+	}
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		var id uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentExt), "%d", &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d%v", id, segmentExt))
+}
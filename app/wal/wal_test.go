@@ -0,0 +1,131 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qwlt/gmcollector/app/models"
+	"github.com/stretchr/testify/require"
+)
+
+func newMeasurement(v float64) models.Measurement {
+	return models.Measurement{DeviceID: uuid.New(), Value: v, Timestamp: time.Now().UTC()}
+}
+
+func replayAll(t *testing.T, conf Config) []models.Model {
+	w, err := Open(conf)
+	require.NoError(t, err)
+	defer w.Close()
+	var replayed []models.Model
+	_, err = w.Replay(2, func(batch []models.Model) error {
+		replayed = append(replayed, batch...)
+		return nil
+	})
+	require.NoError(t, err)
+	return replayed
+}
+
+func TestReplayUncommitted(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), Fsync: FsyncNone}
+	w, err := Open(conf)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Append(newMeasurement(float64(i))))
+	}
+	require.NoError(t, w.Commit(2))
+	require.NoError(t, w.Close())
+
+	replayed := replayAll(t, conf)
+	// records committed before close are skipped
+	require.Len(t, replayed, 3)
+	require.Equal(t, 2.0, replayed[0].(models.Measurement).Value)
+	require.Equal(t, 4.0, replayed[2].(models.Measurement).Value)
+
+	require.Empty(t, replayAll(t, conf))
+}
+
+func TestReplayPartiallyCommittedSegment(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), Fsync: FsyncAlways, SegmentSize: 300}
+	w, err := Open(conf)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, w.Append(newMeasurement(float64(i))))
+	}
+	require.Greater(t, len(w.segments), 1)
+	require.Greater(t, w.segments[0].records, 1)
+	// simulates crash, first segment is sealed and partially committed
+	require.NoError(t, w.Commit(1))
+	require.NoError(t, w.Close())
+
+	w, err = Open(conf)
+	require.NoError(t, err)
+	var replayed []float64
+	calls := 0
+	failing := func(batch []models.Model) error {
+		calls++
+		if calls == 2 {
+			return errors.New("storage is down")
+		}
+		for i := range batch {
+			replayed = append(replayed, batch[i].(models.Measurement).Value)
+		}
+		return nil
+	}
+	_, err = w.Replay(1, failing)
+	require.Error(t, err)
+	require.Equal(t, []float64{1}, replayed)
+	require.NoError(t, w.Close())
+
+	// failed replay resumes after the last handled batch
+	var rest []float64
+	for _, dp := range replayAll(t, conf) {
+		rest = append(rest, dp.(models.Measurement).Value)
+	}
+	require.Equal(t, []float64{2, 3, 4, 5}, rest)
+	markers, _ := filepath.Glob(filepath.Join(conf.Dir, "*"+markerExt))
+	require.Empty(t, markers)
+}
+
+func TestCommitRemovesSegments(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), Fsync: FsyncAlways, SegmentSize: 64}
+	w, err := Open(conf)
+	require.NoError(t, err)
+	for i := 0; i < 6; i++ {
+		require.NoError(t, w.Append(newMeasurement(float64(i))))
+	}
+	files, _ := filepath.Glob(filepath.Join(conf.Dir, "*"+segmentExt))
+	require.Len(t, files, 6)
+
+	require.NoError(t, w.Commit(4))
+	files, _ = filepath.Glob(filepath.Join(conf.Dir, "*"+segmentExt))
+	require.Len(t, files, 2)
+	require.NoError(t, w.Close())
+
+	replayed := replayAll(t, conf)
+	require.Len(t, replayed, 2)
+	require.Equal(t, 4.0, replayed[0].(models.Measurement).Value)
+}
+
+func TestDiscardAndTornTail(t *testing.T) {
+	conf := Config{Dir: t.TempDir(), Fsync: FsyncNone}
+	w, err := Open(conf)
+	require.NoError(t, err)
+	require.NoError(t, w.Append(newMeasurement(1)))
+	require.NoError(t, w.Append(newMeasurement(2)))
+	require.NoError(t, w.Discard())
+	require.NoError(t, w.Close())
+
+	f, err := os.OpenFile(w.active.path, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	replayed := replayAll(t, conf)
+	require.Len(t, replayed, 1)
+	require.Equal(t, 1.0, replayed[0].(models.Measurement).Value)
+}
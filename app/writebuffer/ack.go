@@ -0,0 +1,162 @@
+package writebuffer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+const defaultSyncTimeout = 10 * time.Second
+
+var (
+	// ErrAckTimeout - datapoint was not committed while caller waited
+	ErrAckTimeout = errors.New("Datapoint was not committed in time")
+	// ErrNotWritten - buffer was closed before datapoint was written
+	ErrNotWritten = errors.New("Datapoint was not written before shutdown")
+	// ErrWriteThroughModel - acknowledgement needs (DeviceID, Timestamp) to find datapoint in batch
+	ErrWriteThroughModel = errors.New("Write-through is supported for measurements only")
+)
+
+// Ack - completion handle of datapoint added in write-through mode, resolved once
+// batch containing datapoint is committed by storage or datapoint failed
+type Ack struct {
+	done chan struct{}
+	err  error
+}
+
+func newAck() *Ack {
+	return &Ack{done: make(chan struct{})}
+}
+
+func (a *Ack) resolve(err error) {
+	a.err = err
+	close(a.done)
+}
+
+// Done - closed when result is known
+func (a *Ack) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err - nil if datapoint was committed, valid after Done is closed
+func (a *Ack) Err() error {
+	return a.err
+}
+
+// Wait - waits for result up to timeout, returns ErrAckTimeout if it's not known by then,
+// datapoint may still be committed later
+func (a *Ack) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-a.done:
+		return a.err
+	case <-timer.C:
+		return ErrAckTimeout
+	}
+}
+
+// syncDatapoint - datapoint passed through buffer channel together with its completion handle
+type syncDatapoint struct {
+	m.Model
+	ack *Ack
+}
+
+type pendingAck struct {
+	key datapointKey
+	ack *Ack
+}
+
+// AddDatapointSync - puts datapoint into buffer like AddDatapointPriority, returned handle is
+// resolved after batch containing datapoint is written, datapoint is batched with other traffic
+func (w *WriteBuffer) AddDatapointSync(datapoint m.Model, priority Priority) (*Ack, error) {
+	acks, err := w.AddDatapointsSync([]m.Model{datapoint}, priority)
+	if err != nil {
+		return nil, err
+	}
+	return acks[0], nil
+}
+
+// AddDatapointsSync - same as AddDatapointsPriority, returns completion handles of accepted datapoints
+func (w *WriteBuffer) AddDatapointsSync(datapoints []m.Model, priority Priority) ([]*Ack, error) {
+	for i := range datapoints {
+		if _, ok := m.AsMeasurement(datapoints[i]); !ok {
+			return nil, ErrWriteThroughModel
+		}
+	}
+	acks := make([]*Ack, 0, len(datapoints))
+	if len(w.shards) > 0 {
+		for i := range datapoints {
+			ack, err := w.shardFor(datapoints[i]).AddDatapointSync(datapoints[i], priority)
+			if err != nil {
+				return acks, err
+			}
+			acks = append(acks, ack)
+		}
+		return acks, nil
+	}
+	if w.wal != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+	for i := range datapoints {
+		ack := newAck()
+		if err := w.addLocked(datapoints[i], priority, ack); err != nil {
+			return acks, err
+		}
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+// SyncTimeout - max time callers should wait for acknowledgement of write-through datapoint
+func (w *WriteBuffer) SyncTimeout() time.Duration {
+	if w.Conf.SyncTimeout <= 0 {
+		return defaultSyncTimeout
+	}
+	return w.Conf.SyncTimeout
+}
+
+// resolveAcks - resolves handles of written batch, datapoints rejected by storage
+// or moved to dead letter store fail with their error
+func resolveAcks(acks []pendingAck, rejected []RowError, deadLettered []m.Model, deadLetterErr error) {
+	if len(acks) == 0 {
+		return
+	}
+	failed := make(map[datapointKey]error, len(rejected)+len(deadLettered))
+	for _, r := range rejected {
+		if key, ok := keyOf(r.Datapoint); ok {
+			failed[key] = r.Err
+		}
+	}
+	for i := range deadLettered {
+		if key, ok := keyOf(deadLettered[i]); ok {
+			failed[key] = fmt.Errorf("moved to dead letter store: %w", deadLetterErr)
+		}
+	}
+	for _, a := range acks {
+		a.ack.resolve(failed[a.key])
+	}
+}
+
+// failQueuedAcks - fails handles of datapoints left in channel after data handler stopped
+func (w *WriteBuffer) failQueuedAcks() {
+	for {
+		select {
+		case datapoint := <-w.dataChan:
+			if sync, ok := datapoint.(*syncDatapoint); ok {
+				sync.ack.resolve(ErrNotWritten)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func failAcks(acks []pendingAck, err error) {
+	for _, a := range acks {
+		a.ack.resolve(err)
+	}
+}
@@ -0,0 +1,176 @@
+package writebuffer
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/qwlt/gmcollector/app/metrics"
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+// Admission policies applied when buffer channel is full
+const (
+	// AdmissionBlock - wait for free space up to Timeout
+	AdmissionBlock = "block"
+	// AdmissionReject - fail immediately
+	AdmissionReject = "reject"
+	// AdmissionShed - reject low priority datapoints once channel occupancy exceeds
+	// ShedThreshold, wait for free space up to Timeout for others
+	AdmissionShed = "shed"
+)
+
+// Priority - importance of datapoint for admission under load
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityLow
+)
+
+var (
+	// ErrBufferFull - datapoint was rejected because buffer channel is full
+	ErrBufferFull = errors.New("Buffer is full")
+	// ErrShed - low priority datapoint was rejected because buffer is under load
+	ErrShed = errors.New("Buffer is shedding low priority datapoints")
+)
+
+// IsOverloaded - reports whether error means buffer could not accept datapoint because of load,
+// such datapoints may be sent again later
+func IsOverloaded(err error) bool {
+	return errors.Is(err, TimeoutError) || errors.Is(err, ErrBufferFull) || errors.Is(err, ErrShed)
+}
+
+// AdmissionConfig - policy of accepting datapoints into buffer channel
+// Policy - `block` (default), `reject` or `shed`
+// Timeout - max time producer waits for free space, 1s by default
+// ShedThreshold - fraction of channel capacity after which low priority datapoints are shed, 0.8 by default
+type AdmissionConfig struct {
+	Policy        string        `mapstructure:"policy"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+	ShedThreshold float64       `mapstructure:"shedThreshold"`
+}
+
+func (c AdmissionConfig) validate() error {
+	switch c.Policy {
+	case "", AdmissionBlock, AdmissionReject, AdmissionShed:
+	default:
+		return fmt.Errorf("unknown admission policy `%v`", c.Policy)
+	}
+	if c.ShedThreshold < 0 || c.ShedThreshold > 1 {
+		return fmt.Errorf("admission shedThreshold must be between 0 and 1, got %v", c.ShedThreshold)
+	}
+	return nil
+}
+
+func (c AdmissionConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Second
+	}
+	return c.Timeout
+}
+
+func (c AdmissionConfig) shedThreshold() float64 {
+	if c.ShedThreshold <= 0 {
+		return 0.8
+	}
+	return c.ShedThreshold
+}
+
+func (w *WriteBuffer) send(datapoint m.Model, priority Priority) error {
+	conf := w.Conf.Admission
+	switch {
+	case conf.Policy == AdmissionShed && priority == PriorityLow &&
+		float64(len(w.dataChan)) >= conf.shedThreshold()*float64(cap(w.dataChan)):
+		metrics.BufferRejections.WithLabelValues("shed").Inc()
+		return ErrShed
+	case conf.Policy == AdmissionReject:
+		select {
+		case w.dataChan <- datapoint:
+			return nil
+		default:
+			metrics.BufferRejections.WithLabelValues("full").Inc()
+			return ErrBufferFull
+		}
+	}
+	timer := time.NewTimer(conf.timeout())
+	defer timer.Stop()
+	select {
+	case w.dataChan <- datapoint:
+		return nil
+	case <-timer.C:
+		metrics.BufferTimeouts.Inc()
+		return TimeoutError
+	}
+}
+
+const (
+	drainSmoothing = 0.3
+	minRetryAfter  = time.Second
+	maxRetryAfter  = time.Minute
+	// used until first flushes are measured
+	defaultRetryAfter = 5 * time.Second
+)
+
+// drainMeter - exponentially weighted moving average of datapoints flushed per second
+type drainMeter struct {
+	mu   sync.Mutex
+	rate float64
+	last time.Time
+}
+
+func (d *drainMeter) record(n int, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.last.IsZero() {
+		if elapsed := now.Sub(d.last).Seconds(); elapsed > 0 {
+			sample := float64(n) / elapsed
+			if d.rate == 0 {
+				d.rate = sample
+			} else {
+				d.rate = drainSmoothing*sample + (1-drainSmoothing)*d.rate
+			}
+		}
+	}
+	d.last = now
+}
+
+func (d *drainMeter) get() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rate
+}
+
+// DrainRate - smoothed number of datapoints flushed per second
+func (w *WriteBuffer) DrainRate() float64 {
+	if len(w.shards) > 0 {
+		rate := 0.0
+		for _, s := range w.shards {
+			rate += s.DrainRate()
+		}
+		return rate
+	}
+	return w.drain.get()
+}
+
+// RetryAfter - estimated time until datapoints waiting in channel are drained,
+// clients rejected because of load should wait this long before sending again
+func (w *WriteBuffer) RetryAfter() time.Duration {
+	return retryAfter(w.ChannelLength(), w.DrainRate())
+}
+
+func retryAfter(backlog int, rate float64) time.Duration {
+	if rate <= 0 {
+		return defaultRetryAfter
+	}
+	d := time.Duration(math.Ceil(float64(backlog)/rate)) * time.Second
+	if d < minRetryAfter {
+		return minRetryAfter
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
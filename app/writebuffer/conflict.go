@@ -0,0 +1,93 @@
+package writebuffer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+// Conflict policies for datapoints with (DeviceID, Timestamp) already stored
+const (
+	// ConflictIgnore - keep stored datapoint, new one is skipped
+	ConflictIgnore = "ignore"
+	// ConflictUpdate - overwrite value and metadata of stored datapoint
+	ConflictUpdate = "update"
+	// ConflictReject - datapoint violating unique index is isolated from batch and sent
+	// to reject log like other rejected rows, the rest of batch is committed
+	ConflictReject = "reject"
+)
+
+func validateConflict(mode string) error {
+	switch mode {
+	case ConflictIgnore, ConflictUpdate, ConflictReject:
+		return nil
+	default:
+		return fmt.Errorf("unknown conflict policy `%v`", mode)
+	}
+}
+
+// ConflictClause - `ON CONFLICT` clause of INSERT for given policy
+func ConflictClause(mode string) string {
+	switch mode {
+	case ConflictIgnore:
+		return " ON CONFLICT (uid, datetime) DO NOTHING"
+	case ConflictUpdate:
+		return " ON CONFLICT (uid, datetime) DO UPDATE SET value = EXCLUDED.value, metadata = EXCLUDED.metadata"
+	default:
+		return ""
+	}
+}
+
+type datapointKey struct {
+	id uuid.UUID
+	ts int64
+}
+
+// keyOf - (DeviceID, Timestamp) of measurement with microsecond precision of postgres
+func keyOf(datapoint m.Model) (datapointKey, bool) {
+	v, ok := m.AsMeasurement(datapoint)
+	if !ok {
+		return datapointKey{}, false
+	}
+	return datapointKey{id: v.DeviceID, ts: v.Timestamp.Round(time.Microsecond).UnixNano()}, true
+}
+
+// Deduplicate - removes datapoints with the same DeviceID and Timestamp from batch,
+// timestamps are compared with microsecond precision of postgres, keeps last occurrence
+// if keepLast is set, first otherwise; returns original slice if there are no duplicates
+func Deduplicate(data []m.Model, keepLast bool) ([]m.Model, int) {
+	index := make(map[datapointKey]int, len(data))
+	var unique []m.Model
+	for i := range data {
+		key, ok := keyOf(data[i])
+		if !ok {
+			if unique != nil {
+				unique = append(unique, data[i])
+			}
+			continue
+		}
+		pos, seen := index[key]
+		if !seen {
+			if unique != nil {
+				index[key] = len(unique)
+				unique = append(unique, data[i])
+			} else {
+				index[key] = i
+			}
+			continue
+		}
+		if unique == nil {
+			unique = make([]m.Model, i, len(data))
+			copy(unique, data[:i])
+		}
+		if keepLast {
+			unique[pos] = data[i]
+		}
+	}
+	if unique == nil {
+		return data, 0
+	}
+	return unique, len(data) - len(unique)
+}
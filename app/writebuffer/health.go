@@ -0,0 +1,77 @@
+package writebuffer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthState - data handler liveness and outcome of flushes, safe for concurrent use
+type healthState struct {
+	running   int32
+	mu        sync.Mutex
+	lastOK    time.Time
+	lastErrAt time.Time
+	lastErr   error
+}
+
+// Health - snapshot of write buffer state used by readiness checks
+type Health struct {
+	Running       bool
+	FlushInterval time.Duration
+	LastSuccess   time.Time
+	LastErrorAt   time.Time
+	LastError     error
+}
+
+func (h *healthState) setRunning(running bool) {
+	var v int32
+	if running {
+		v = 1
+	}
+	atomic.StoreInt32(&h.running, v)
+}
+
+func (h *healthState) recordFlush(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastErr = err
+		h.lastErrAt = time.Now()
+		return
+	}
+	h.lastOK = time.Now()
+}
+
+// Health - state of buffer, for sharded buffer state of the worst shard:
+// Running if all shards run, the oldest LastSuccess and the latest error
+func (w *WriteBuffer) Health() Health {
+	if len(w.shards) > 0 {
+		h := Health{Running: true, FlushInterval: w.flushInterval()}
+		for i, s := range w.shards {
+			sh := s.Health()
+			h.Running = h.Running && sh.Running
+			if i == 0 || sh.LastSuccess.Before(h.LastSuccess) {
+				h.LastSuccess = sh.LastSuccess
+			}
+			if sh.LastErrorAt.After(h.LastErrorAt) {
+				h.LastErrorAt, h.LastError = sh.LastErrorAt, sh.LastError
+			}
+		}
+		return h
+	}
+	w.health.mu.Lock()
+	defer w.health.mu.Unlock()
+	return Health{
+		Running:       atomic.LoadInt32(&w.health.running) == 1,
+		FlushInterval: w.flushInterval(),
+		LastSuccess:   w.health.lastOK,
+		LastErrorAt:   w.health.lastErrAt,
+		LastError:     w.health.lastErr,
+	}
+}
+
+// flushInterval - max duration between two flushes
+func (w *WriteBuffer) flushInterval() time.Duration {
+	return time.Duration(w.Conf.WriteTimeout) * time.Second
+}
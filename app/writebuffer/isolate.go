@@ -0,0 +1,85 @@
+package writebuffer
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	m "github.com/qwlt/gmcollector/app/models"
+	"github.com/qwlt/gmcollector/app/rejectlog"
+)
+
+// RowError - datapoint rejected by storage because of its content
+type RowError struct {
+	Datapoint m.Model
+	Err       error
+}
+
+// IsRowError - reports whether write failed because of data itself, such errors
+// are not retried, class 22 is data exception and class 23 is integrity constraint violation
+func IsRowError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+}
+
+// writeIsolated - writes data, on row level failure batch is bisected until offending
+// datapoints are found, the rest is committed; on other errors returns datapoints
+// which were not committed yet, so only they are retried
+func (w *WriteBuffer) writeIsolated(data []m.Model) ([]m.Model, []RowError, error) {
+	var rejected []RowError
+	queue := [][]m.Model{data}
+	for len(queue) > 0 {
+		chunk := queue[0]
+		err := w.Storage.Write(chunk)
+		switch {
+		case err == nil:
+			queue = queue[1:]
+		case !IsRowError(err):
+			rest := make([]m.Model, 0, len(data))
+			for _, c := range queue {
+				rest = append(rest, c...)
+			}
+			return rest, rejected, err
+		case len(chunk) == 1:
+			rejected = append(rejected, RowError{Datapoint: chunk[0], Err: err})
+			queue = queue[1:]
+		default:
+			mid := len(chunk) / 2
+			queue = append([][]m.Model{chunk[:mid], chunk[mid:]}, queue[1:]...)
+		}
+	}
+	return nil, rejected, nil
+}
+
+// logRejected - appends rejected datapoints to reject log, without it they are only logged
+func (w *WriteBuffer) logRejected(rejected []RowError) {
+	if w.rejectLog == nil {
+		for _, r := range rejected {
+			log.Printf("Datapoint %+v rejected by storage: %v", r.Datapoint, r.Err)
+		}
+		return
+	}
+	now := time.Now()
+	entries := make([]rejectlog.Entry, 0, len(rejected))
+	for _, r := range rejected {
+		v, ok := m.AsMeasurement(r.Datapoint)
+		if !ok {
+			log.Printf("Datapoint %+v rejected by storage: %v", r.Datapoint, r.Err)
+			continue
+		}
+		entry := rejectlog.Entry{Time: now, Error: r.Err.Error(), Datapoint: v}
+		var pgErr *pgconn.PgError
+		if errors.As(r.Err, &pgErr) {
+			entry.Code = pgErr.Code
+		}
+		entries = append(entries, entry)
+	}
+	if err := w.rejectLog.Write(entries); err != nil {
+		log.Printf("Cant write %v rejected datapoints to reject log: %v", len(entries), err)
+	}
+}
@@ -0,0 +1,120 @@
+package writebuffer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+// Latest - last value reported by device
+type Latest struct {
+	DeviceID  uuid.UUID              `json:"id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// LatestCache - last value per device, kept up to date by AddDatapoint,
+// datapoints older than cached one are ignored, so late arrivals don't roll value back
+type LatestCache struct {
+	mu     sync.RWMutex
+	values map[uuid.UUID]Latest
+}
+
+func NewLatestCache() *LatestCache {
+	return &LatestCache{values: make(map[uuid.UUID]Latest)}
+}
+
+// Update - stores datapoint if it is newer than cached value of its device
+func (l *LatestCache) Update(datapoint m.Model) {
+	v, ok := m.AsMeasurement(datapoint)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cur, ok := l.values[v.DeviceID]; ok && !v.Timestamp.After(cur.Timestamp) {
+		return
+	}
+	l.values[v.DeviceID] = Latest{DeviceID: v.DeviceID, Timestamp: v.Timestamp, Value: v.Value, Metadata: v.Metadata}
+}
+
+func (l *LatestCache) Get(id uuid.UUID) (Latest, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	v, ok := l.values[id]
+	return v, ok
+}
+
+// GetMany - returns cached values of given devices and ids of devices without value
+func (l *LatestCache) GetMany(ids []uuid.UUID) ([]Latest, []uuid.UUID) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	found := make([]Latest, 0, len(ids))
+	missing := make([]uuid.UUID, 0)
+	for _, id := range ids {
+		if v, ok := l.values[id]; ok {
+			found = append(found, v)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing
+}
+
+// Stale - returns devices whose last value is older than threshold, most silent first
+func (l *LatestCache) Stale(threshold time.Duration, now time.Time) []Latest {
+	deadline := now.Add(-threshold)
+	l.mu.RLock()
+	stale := make([]Latest, 0)
+	for _, v := range l.values {
+		if v.Timestamp.Before(deadline) {
+			stale = append(stale, v)
+		}
+	}
+	l.mu.RUnlock()
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Timestamp.Before(stale[j].Timestamp) })
+	return stale
+}
+
+func (l *LatestCache) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.values)
+}
+
+const defaultWarmWindow = 24 * time.Hour
+
+// Warm - loads last value stored since given time of every device from table, devices silent
+// for longer are not cached until they report again, scan of the whole table may take too long
+func (l *LatestCache) Warm(ctx context.Context, pool *pgxpool.Pool, tablename string, since time.Time) error {
+	rows, err := pool.Query(ctx, fmt.Sprintf(
+		"SELECT DISTINCT ON (uid) uid, datetime, value, metadata FROM %v WHERE datetime >= $1 ORDER BY uid, datetime DESC",
+		tablename), since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		v := m.Measurement{}
+		if err := rows.Scan(&v.DeviceID, &v.Timestamp, &v.Value, &v.Metadata); err != nil {
+			return err
+		}
+		l.Update(v)
+	}
+	return rows.Err()
+}
+
+// WarmWindow - how far back latest values cache is warmed on start
+func (w *WriteBuffer) WarmWindow() time.Duration {
+	if w.Conf.WarmWindow <= 0 {
+		return defaultWarmWindow
+	}
+	return w.Conf.WarmWindow
+}
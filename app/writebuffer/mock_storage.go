@@ -1,6 +1,12 @@
 package writebuffer
 
-import "github.com/qwlt/gmcollector/app/models"
+import (
+	"sync"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/qwlt/gmcollector/app/models"
+)
 
 type MockStorage struct {
 }
@@ -8,3 +14,70 @@ type MockStorage struct {
 func (s *MockStorage) Write(data []models.Model) error {
 	return nil
 }
+
+// FailingStorage - storage which rejects every write, counting attempts
+type FailingStorage struct {
+	Err      error
+	Attempts int
+}
+
+func (s *FailingStorage) Write(data []models.Model) error {
+	s.Attempts++
+	return s.Err
+}
+
+// RecordingStorage - storage which keeps every written batch
+type RecordingStorage struct {
+	Batches [][]models.Model
+}
+
+func (s *RecordingStorage) Write(data []models.Model) error {
+	s.Batches = append(s.Batches, append([]models.Model(nil), data...))
+	return nil
+}
+
+// RejectingStorage - storage which fails whole batch with data exception if it contains
+// datapoint with Value equal to Bad, other batches are kept
+type RejectingStorage struct {
+	Bad     float64
+	Calls   int
+	Written []models.Model
+}
+
+func (s *RejectingStorage) Write(data []models.Model) error {
+	s.Calls++
+	for i := range data {
+		if v, ok := models.AsMeasurement(data[i]); ok && v.Value == s.Bad {
+			return &pgconn.PgError{Code: "22P02", Message: "invalid input syntax"}
+		}
+	}
+	s.Written = append(s.Written, data...)
+	return nil
+}
+
+// SlowStorage - concurrency safe storage which takes Delay per write and tracks
+// max number of concurrent writes and sizes of written batches
+type SlowStorage struct {
+	Delay     time.Duration
+	mu        sync.Mutex
+	active    int
+	MaxActive int
+	Written   []models.Model
+	Batches   []int
+}
+
+func (s *SlowStorage) Write(data []models.Model) error {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.MaxActive {
+		s.MaxActive = s.active
+	}
+	s.mu.Unlock()
+	time.Sleep(s.Delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	s.Written = append(s.Written, data...)
+	s.Batches = append(s.Batches, len(data))
+	return nil
+}
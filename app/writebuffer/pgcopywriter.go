@@ -0,0 +1,89 @@
+package writebuffer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/qwlt/gmcollector/app/models"
+)
+
+const (
+	WriterInsert = "insert"
+	WriterCopy   = "copy"
+)
+
+// PGCopyWriter - writes batches using postgres COPY protocol, which has no
+// bind parameters limit and is faster than multi-row INSERT for large batches
+// COPY has no conflict handling, so unless policy is `reject` batch is
+// copied into temporary table first and then inserted with `ON CONFLICT` clause
+type PGCopyWriter struct {
+	ConnPool         *pgxpool.Pool
+	TableName        string
+	Conflict         string
+	RowCountMismatch string
+}
+
+const copyStagingTable = "gmc_copy_staging"
+
+func NewPGCopyWriter(conf *PGWriterConfig) *PGCopyWriter {
+	return &PGCopyWriter{ConnPool: conf.Pool, TableName: conf.TableName, Conflict: conf.Conflict, RowCountMismatch: conf.RowCountMismatch}
+}
+
+// Write - copies batch of data into database within single transaction
+func (pg *PGCopyWriter) Write(data []models.Model) error {
+	if len(data) == 0 {
+		return nil
+	}
+	rows := make([][]interface{}, len(data))
+	for i := range data {
+		rows[i] = data[i].Flatten()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	tx, err := pg.ConnPool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	target := tableIdentifier(pg.TableName)
+	staged := pg.Conflict != "" && pg.Conflict != ConflictReject
+	if staged {
+		_, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %v (LIKE %v INCLUDING DEFAULTS) ON COMMIT DROP",
+			copyStagingTable, target.Sanitize()))
+		if err != nil {
+			return err
+		}
+		target = pgx.Identifier{copyStagingTable}
+	}
+	n, err := tx.CopyFrom(ctx, target, MeasurementColumns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return err
+	}
+	if err := checkRowCount(pg.RowCountMismatch, int64(len(data)), n); err != nil {
+		return err
+	}
+	if staged {
+		columns := strings.Join(MeasurementColumns, ", ")
+		com, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %v (%v) SELECT %v FROM %v%v",
+			tableIdentifier(pg.TableName).Sanitize(), columns, columns, copyStagingTable, ConflictClause(pg.Conflict)))
+		if err != nil {
+			return err
+		}
+		if err := checkInsertedRows(pg.RowCountMismatch, pg.Conflict, int64(len(data)), com.RowsAffected()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// tableIdentifier - splits optionally schema qualified table name
+func tableIdentifier(tablename string) pgx.Identifier {
+	return pgx.Identifier(strings.Split(tablename, "."))
+}
@@ -12,17 +12,21 @@ import (
 	"github.com/qwlt/gmcollector/app/models"
 )
 
+// MeasurementColumns - table columns in the order of fields returned by Measurement.Flatten
+var MeasurementColumns = []string{"uid", "datetime", "value", "metadata"}
+
 // PGWriter - wrapper around postgres connections pool
 type PGWriter struct {
-	ConnPool  *pgxpool.Pool
-	TableName string
+	ConnPool         *pgxpool.Pool
+	TableName        string
+	Conflict         string
+	RowCountMismatch string
 }
 
 // Write - inserts batch of data into database or in case of any errors
-// reject batch entierly
+// reject batch entierly, mismatch of affected rows is handled according to RowCountMismatch policy
 func (pg *PGWriter) Write(data []models.Model) error {
 
-
 	if len(data) == 0 {
 		return nil
 	}
@@ -31,7 +35,7 @@ func (pg *PGWriter) Write(data []models.Model) error {
 
 		flatData = append(flatData, data[i].Flatten()...)
 	}
-	query := BuildQueryString(pg.TableName, len(data), len(data[1].Flatten()))
+	query := BuildConflictQueryString(pg.TableName, MeasurementColumns, len(data), pg.Conflict)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
@@ -49,34 +53,41 @@ func (pg *PGWriter) Write(data []models.Model) error {
 		log.Println(txErr)
 		return err
 	}
-	if com.RowsAffected() == int64(len(data)) {
-		commitCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	if err := checkInsertedRows(pg.RowCountMismatch, pg.Conflict, int64(len(data)), com.RowsAffected()); err != nil {
+		rollbackCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 		defer cancel()
-		err := tx.Commit(commitCtx)
-		if err != nil {
-			return err
+		if txErr := tx.Rollback(rollbackCtx); txErr != nil {
+			log.Println(txErr)
 		}
-		return nil
-	} else {
-		panic(fmt.Sprintf("Number of affected rows %v != len(data) %v", com.RowsAffected(), len(data)))
+		return err
 	}
-
+	commitCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return tx.Commit(commitCtx)
 }
 
 type PGWriterConfig struct {
-	TableName string
-	Pool      *pgxpool.Pool
+	TableName        string
+	Pool             *pgxpool.Pool
+	Conflict         string
+	RowCountMismatch string
 }
 
 func NewPGWriter(conf *PGWriterConfig) *PGWriter {
-	return &PGWriter{ConnPool: conf.Pool, TableName: conf.TableName}
+	return &PGWriter{ConnPool: conf.Pool, TableName: conf.TableName, Conflict: conf.Conflict, RowCountMismatch: conf.RowCountMismatch}
 
 }
 
 // BuildQueryString - generates single  `INSERT` SQL query for given slice of datapoints
 // considering number of fields in a datapoint model
-func BuildQueryString(tablename string, numRecords, numColumns int) string {
-	insert := fmt.Sprintf("INSERT INTO %v (uid, datetime, value) VALUES ", tablename)
+func BuildQueryString(tablename string, columns []string, numRecords int) string {
+	return BuildConflictQueryString(tablename, columns, numRecords, "")
+}
+
+// BuildConflictQueryString - same as BuildQueryString with `ON CONFLICT` clause of given policy
+func BuildConflictQueryString(tablename string, columns []string, numRecords int, conflict string) string {
+	numColumns := len(columns)
+	insert := fmt.Sprintf("INSERT INTO %v (%v) VALUES ", tablename, strings.Join(columns, ", "))
 	argCounter := 0
 	var sb strings.Builder
 	// 2 parentheses, $n + coma per column
@@ -98,6 +109,7 @@ func BuildQueryString(tablename string, numRecords, numColumns int) string {
 			sb.WriteString(",")
 		}
 	}
+	sb.WriteString(ConflictClause(conflict))
 	sb.WriteString(";")
 	return sb.String()
 
@@ -11,16 +11,14 @@ import (
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/qwlt/gmcollector/app/migrations"
 )
 
 var P *pgxpool.Pool
 
-func setup(b *testing.B) {
+const benchTable = "test_measurements"
 
-	setupTable := `
-	CREATE TABLE test_measurements(uid UUID ,time TIMESTAMPTZ,value real,metadata JSONB);
-	CREATE INDEX pk_time_index ON test_measurements(uid,time);
-	`
+func setup(b *testing.B) {
 
 	connStr := "postgresql://postgres:postgres@db:5432/postgres"
 	pconf, err := pgxpool.ParseConfig(connStr)
@@ -33,30 +31,31 @@ func setup(b *testing.B) {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
-	conn, err := P.Acquire(ctx)
+	migrator, err := migrations.New(P, benchTable)
 	if err != nil {
-		panic(fmt.Sprintf("Cant acquire connection from pool with err = %v", err))
+		b.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx); err != nil {
+		b.Fatal(err)
 	}
-	conn.Exec(ctx, setupTable)
 
 }
 
 func teardown(b *testing.B) {
 
-	removeTable := `
-	DROP TABLE IF EXISTS test_measurements;
-	`
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
-	conn, err := P.Acquire(ctx)
+	migrator, err := migrations.New(P, benchTable)
 	if err != nil {
-		panic(fmt.Sprintf("Cant acquire connection from pool with err = %v in teardown", err))
+		b.Fatal(err)
 	}
-	_, err = conn.Exec(ctx, removeTable)
+	statuses, err := migrator.Status(ctx)
 	if err != nil {
+		b.Fatal(err)
+	}
+	if _, err := migrator.Down(ctx, len(statuses)); err != nil {
 		b.Log(err)
 	}
-	conn.Release()
 }
 
 func countRows(b *testing.B) {
@@ -105,16 +104,30 @@ func BenchmarkDbWriteThroughput(b *testing.B) {
 	})
 	countRows(b)
 	teardown(b)
+	setup(b)
+	b.Run("CopyFromInsert", func(b *testing.B) {
+		CopyFromInsert(numRecords, b)
+	})
+	countRows(b)
+	teardown(b)
 
 }
 
-func SequentialRowInsert(numRecords int, b *testing.B) {
-	insertStmt := `INSERT INTO test_measurements VALUES ($1,$2,$3,$4);`
-	data := make([]M, numRecords)
+// benchData - generates records with unique (uid, time), so repeated inserts don't hit unique index
+func benchData(numRecords int) []M {
+	data := make([]M, 0, numRecords)
 	for i := 0; i < numRecords; i++ {
 		data = append(data, M{Uid: uuid.New(), Time: time.Now(), Value: rand.Float32(), Metadata: map[string]interface{}{fmt.Sprintf("%v", i): i}})
 	}
+	return data
+}
+
+func SequentialRowInsert(numRecords int, b *testing.B) {
+	insertStmt := `INSERT INTO test_measurements VALUES ($1,$2,$3,$4);`
 	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		data := benchData(numRecords)
+		b.StartTimer()
 
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 		defer cancel()
@@ -130,13 +143,11 @@ func SequentialRowInsert(numRecords int, b *testing.B) {
 
 func BatchRowInsert(numRecords int, b *testing.B) {
 	insertStmt := `INSERT INTO test_measurements VALUES ($1,$2,$3,$4);`
-	data := make([]M, 0, 1024)
-
-	for i := 0; i < numRecords; i++ {
-		data = append(data, M{Uid: uuid.New(), Time: time.Now(), Value: rand.Float32(), Metadata: map[string]interface{}{fmt.Sprintf("%v", i): i}})
-	}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		data := benchData(numRecords)
+		b.StartTimer()
 		batch := &pgx.Batch{}
 
 		for i := range data {
@@ -164,21 +175,18 @@ func BatchRowInsert(numRecords int, b *testing.B) {
 
 func SingleQueryInsert(numRecords int, b *testing.B) {
 
-	data := make([]M, 0, numRecords)
-	for i := 0; i < numRecords; i++ {
-		data = append(data, M{Uid: uuid.New(), Time: time.Now(), Value: rand.Float32(), Metadata: map[string]interface{}{fmt.Sprintf("%v", i): i}})
-	}
-
-	valueArgs := make([]interface{}, 0, len(data)*3)
-	for i := range data {
-		// var r M
-		r := data[i]
-		valueArgs = append(valueArgs, r.Uid, r.Time, r.Value, r.Metadata)
-	}
-	sqlQuery := BuildQueryString("test_measurements", len(data), 4)
+	sqlQuery := BuildQueryString(benchTable, MeasurementColumns, numRecords)
 	b.ResetTimer()
 	var count int
 	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		data := benchData(numRecords)
+		valueArgs := make([]interface{}, 0, len(data)*4)
+		for i := range data {
+			r := data[i]
+			valueArgs = append(valueArgs, r.Uid, r.Time, r.Value, r.Metadata)
+		}
+		b.StartTimer()
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 		defer cancel()
 		_, err := P.Exec(ctx, sqlQuery, valueArgs...)
@@ -193,3 +201,23 @@ func SingleQueryInsert(numRecords int, b *testing.B) {
 	}
 
 }
+
+func CopyFromInsert(numRecords int, b *testing.B) {
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rows := make([][]interface{}, 0, numRecords)
+		for _, r := range benchData(numRecords) {
+			rows = append(rows, []interface{}{r.Uid, r.Time, r.Value, r.Metadata})
+		}
+		b.StartTimer()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_, err := P.CopyFrom(ctx, pgx.Identifier{benchTable}, MeasurementColumns, pgx.CopyFromRows(rows))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+}
@@ -0,0 +1,96 @@
+package writebuffer
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+// RetryConfig - policy of retrying failed storage writes
+// MaxAttempts - total number of write attempts, including the first one
+// InitialBackoff - delay before the second attempt
+// MaxBackoff - upper limit of delay between attempts
+// Multiplier - factor applied to delay after each failed attempt
+// Jitter - fraction of delay which is randomized, from 0 to 1
+type RetryConfig struct {
+	MaxAttempts    int           `mapstructure:"maxAttempts"`
+	InitialBackoff time.Duration `mapstructure:"initialBackoff"`
+	MaxBackoff     time.Duration `mapstructure:"maxBackoff"`
+	Multiplier     float64       `mapstructure:"multiplier"`
+	Jitter         float64       `mapstructure:"jitter"`
+}
+
+// Backoff - delay before next attempt after given number of failed attempts
+func (c RetryConfig) Backoff(attempt int) time.Duration {
+	if c.InitialBackoff <= 0 {
+		return 0
+	}
+	multiplier := c.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	delay := float64(c.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if c.MaxBackoff > 0 && delay > float64(c.MaxBackoff) {
+		delay = float64(c.MaxBackoff)
+	}
+	if c.Jitter > 0 {
+		jitter := math.Min(c.Jitter, 1)
+		delay = delay * (1 - jitter + jitter*rand.Float64())
+	}
+	return time.Duration(delay)
+}
+
+// writeWithRetry - writes data to storage until it succeeds or attempts are exhausted,
+// rows rejected by storage are isolated and not retried, row count mismatch is not retried
+// under `deadletter` policy, backoff is cut short by Shutdown and no more attempts are made then;
+// returns number of attempts made, datapoints left unwritten, rejected rows and the last error
+func (w *WriteBuffer) writeWithRetry(data []m.Model) (int, []m.Model, []RowError, error) {
+	attempts := w.Conf.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var rejected []RowError
+	var err error
+	pending := data
+	attempt := 1
+	for ; ; attempt++ {
+		var failed []RowError
+		pending, failed, err = w.writeIsolated(pending)
+		rejected = append(rejected, failed...)
+		if err == nil {
+			return attempt, nil, rejected, nil
+		}
+		var mismatch *RowCountMismatchError
+		if attempt == attempts || (errors.As(err, &mismatch) && w.Conf.RowCountMismatch == RowCountDeadLetter) {
+			break
+		}
+		delay := w.Conf.Retry.Backoff(attempt)
+		log.Printf("Write of %v datapoints failed (attempt %v/%v): %v, retrying in %v", len(pending), attempt, attempts, err, delay)
+		if !w.sleep(delay) {
+			log.Printf("Buffer is stopping, giving up write of %v datapoints", len(pending))
+			break
+		}
+	}
+	return attempt, pending, rejected, err
+}
+
+// sleep - waits for delay, returns false if buffer was stopped meanwhile or before
+func (w *WriteBuffer) sleep(delay time.Duration) bool {
+	select {
+	case <-w.stopped:
+		return false
+	default:
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.stopped:
+		return false
+	}
+}
@@ -0,0 +1,62 @@
+package writebuffer
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/qwlt/gmcollector/app/metrics"
+)
+
+// Policies for batches where storage affected other number of rows than was written
+const (
+	// RowCountCommit - commit transaction anyway, mismatch is only logged
+	RowCountCommit = "commit"
+	// RowCountRetry - rollback and retry batch as any other failed write
+	RowCountRetry = "retry"
+	// RowCountDeadLetter - rollback and move batch to dead letter store without retries
+	RowCountDeadLetter = "deadletter"
+)
+
+// RowCountMismatchError - number of rows affected by write differs from batch size,
+// may happen because of triggers, rules or conflict clauses on the table
+type RowCountMismatchError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *RowCountMismatchError) Error() string {
+	return fmt.Sprintf("Number of affected rows %v != len(data) %v", e.Actual, e.Expected)
+}
+
+func validateRowCountPolicy(policy string) error {
+	switch policy {
+	case RowCountCommit, RowCountRetry, RowCountDeadLetter:
+		return nil
+	default:
+		return fmt.Errorf("unknown row count mismatch policy `%v`", policy)
+	}
+}
+
+// checkRowCount - returns error if counts differ and policy doesn't allow to commit such batch
+func checkRowCount(policy string, expected, actual int64) error {
+	if expected == actual {
+		return nil
+	}
+	metrics.RowCountMismatches.Inc()
+	err := &RowCountMismatchError{Expected: expected, Actual: actual}
+	if policy == RowCountCommit {
+		log.Printf("%v, committing anyway", err)
+		return nil
+	}
+	return err
+}
+
+// checkInsertedRows - checks row count of INSERT with conflict clause of given policy;
+// ignored conflicts don't affect rows, so under `ignore` fewer rows than batch size is expected
+// and only more rows, e.g. added by rules, is a mismatch
+func checkInsertedRows(policy, conflict string, expected, actual int64) error {
+	if conflict == ConflictIgnore && actual <= expected {
+		return nil
+	}
+	return checkRowCount(policy, expected, actual)
+}
@@ -0,0 +1,128 @@
+package writebuffer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+	m "github.com/qwlt/gmcollector/app/models"
+	"github.com/qwlt/gmcollector/app/wal"
+)
+
+// shardDirPrefix - WAL of every shard is kept in own subdirectory of WAL dir
+const shardDirPrefix = "shard-"
+
+// deviceHash - hash of DeviceID, datapoints of other models get 0;
+// shards use low bits of it and flush workers high bits, so they are spread independently
+func deviceHash(datapoint m.Model) uint32 {
+	v, ok := m.AsMeasurement(datapoint)
+	if !ok {
+		return 0
+	}
+	return hashDevice(v.DeviceID)
+}
+
+func hashDevice(id uuid.UUID) uint32 {
+	h := fnv.New32a()
+	h.Write(id[:])
+	return h.Sum32()
+}
+
+// newShards - creates buffers sharing latest values cache, sharding is disabled in their config
+func newShards(config *WBufferConfig, storage StorageInterface, latest *LatestCache) []*WriteBuffer {
+	conf := *config
+	conf.Shards = 0
+	shards := make([]*WriteBuffer, config.Shards)
+	for i := range shards {
+		shards[i] = NewWriteBuffer(&conf, storage)
+		shards[i].latest = latest
+	}
+	return shards
+}
+
+func (w *WriteBuffer) shardFor(datapoint m.Model) *WriteBuffer {
+	return w.shards[deviceHash(datapoint)%uint32(len(w.shards))]
+}
+
+// Shards - number of shards, 0 if sharding is disabled
+func (w *WriteBuffer) Shards() int {
+	return len(w.shards)
+}
+
+func shardWALConfig(conf wal.Config, i int) wal.Config {
+	if conf.Dir == "" {
+		conf.Dir = "wal"
+	}
+	conf.Dir = filepath.Join(conf.Dir, fmt.Sprintf("%v%v", shardDirPrefix, i))
+	return conf
+}
+
+func (w *WriteBuffer) runShards() {
+	var wg sync.WaitGroup
+	for _, s := range w.shards {
+		wg.Add(1)
+		go func(s *WriteBuffer) {
+			defer wg.Done()
+			s.RunDataHandler()
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (w *WriteBuffer) flushShards() error {
+	var first error
+	for i, s := range w.shards {
+		if err := s.FlushBuffer(); err != nil {
+			err = fmt.Errorf("shard %v: %w", i, err)
+			if first == nil {
+				first = err
+			} else {
+				log.Println(err)
+			}
+		}
+	}
+	return first
+}
+
+// replayOrphanShards - replays and removes WAL of shards which don't exist anymore
+// because shard count was decreased or sharding was disabled
+func (w *WriteBuffer) replayOrphanShards() error {
+	base := w.Conf.WAL
+	if base.Dir == "" {
+		base.Dir = "wal"
+	}
+	dirs, err := filepath.Glob(filepath.Join(base.Dir, shardDirPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		var i int
+		if _, err := fmt.Sscanf(filepath.Base(dir), shardDirPrefix+"%d", &i); err != nil || i < len(w.shards) {
+			continue
+		}
+		conf := base
+		conf.Dir = dir
+		l, err := wal.Open(conf)
+		if err != nil {
+			return err
+		}
+		n, err := l.Replay(w.Conf.BufMaxSize, w.replayBatch)
+		if closeErr := l.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Printf("Replayed %v datapoints from WAL of removed shard %v", n, i)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package writebuffer
+
+import (
+	"fmt"
+	"time"
+
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+// measurementFixedSize - DeviceID, Timestamp and Value
+const measurementFixedSize = 16 + 8 + 8
+
+// DatapointSize - approximate size of datapoint in bytes, metadata is counted as its JSON
+// without spending time on encoding, used to bound size of batches
+func DatapointSize(datapoint m.Model) int {
+	v, ok := m.AsMeasurement(datapoint)
+	if !ok {
+		return 8 * len(datapoint.Flatten())
+	}
+	if v.Metadata == nil {
+		return measurementFixedSize
+	}
+	return measurementFixedSize + jsonSize(v.Metadata)
+}
+
+func jsonSize(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 4
+	case bool:
+		return 5
+	case string:
+		return len(v) + 2
+	case float32, float64, int, int32, int64, uint, uint32, uint64:
+		return 8
+	case map[string]interface{}:
+		n := 2
+		for k, item := range v {
+			n += len(k) + 4 + jsonSize(item)
+		}
+		return n
+	case []interface{}:
+		n := 2
+		for _, item := range v {
+			n += 1 + jsonSize(item)
+		}
+		return n
+	default:
+		return len(fmt.Sprint(v))
+	}
+}
+
+// bufferLimits - flush triggers besides BufMaxSize and WriteTimeout ticker
+type bufferLimits struct {
+	bytes  int
+	oldest time.Time
+	// fires when oldest buffered datapoint reaches MaxAge, nil while not armed
+	age *time.Timer
+}
+
+// ageC - channel of age timer, nil channel blocks forever while timer is not armed
+func (l *bufferLimits) ageC() <-chan time.Time {
+	if l.age == nil {
+		return nil
+	}
+	return l.age.C
+}
+
+// added - accounts datapoint appended to buffer, arms age timer for the first one
+func (l *bufferLimits) added(size int, maxAge time.Duration) {
+	l.bytes += size
+	if l.oldest.IsZero() {
+		l.oldest = time.Now()
+		if maxAge > 0 {
+			l.age = time.NewTimer(maxAge)
+		}
+	}
+}
+
+// flushed - resets limits after buffer was emptied, buffer kept after failed flush keeps
+// its oldest datapoint and age timer is armed again, so write is retried after maxAge
+func (l *bufferLimits) flushed(empty bool, maxAge time.Duration) {
+	l.stop()
+	if empty {
+		l.bytes = 0
+		l.oldest = time.Time{}
+	} else if maxAge > 0 {
+		l.age = time.NewTimer(maxAge)
+	}
+}
+
+// stop - disarms age timer
+func (l *bufferLimits) stop() {
+	if l.age != nil {
+		l.age.Stop()
+		l.age = nil
+	}
+}
@@ -0,0 +1,212 @@
+package writebuffer
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qwlt/gmcollector/app/metrics"
+	m "github.com/qwlt/gmcollector/app/models"
+)
+
+// WorkersConfig - flush workers decoupling collection of datapoints from writes to storage
+// Count - number of goroutines writing batches concurrently, every write holds its own pool
+// connection, so pool should allow at least Count connections; 0 flushes synchronously in data handler
+// QueueSize - max number of batches waiting for workers, data handler blocks when queue is full
+// OrderByDevice - datapoints of a device are always written by the same worker, so they
+// reach storage in the order they were accepted, required for `update` conflict policy
+type WorkersConfig struct {
+	Count         int  `mapstructure:"count"`
+	QueueSize     int  `mapstructure:"queueSize"`
+	OrderByDevice bool `mapstructure:"orderByDevice"`
+}
+
+// flushGroup - contents of one buffer swap, may be split between several workers
+type flushGroup struct {
+	seq       uint64
+	size      int
+	remaining int32
+}
+
+type flushJob struct {
+	data  []m.Model
+	acks  []pendingAck
+	group *flushGroup
+}
+
+// flushPool - bounded queues of batches handled by writer goroutines, with OrderByDevice
+// every worker has own queue, otherwise all workers share single queue
+type flushPool struct {
+	queues   []chan flushJob
+	workers  int
+	wg       sync.WaitGroup
+	inFlight int32
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newFlushPool(conf WorkersConfig) *flushPool {
+	queueSize := conf.QueueSize
+	if queueSize <= 0 {
+		queueSize = 2 * conf.Count
+	}
+	queues := 1
+	if conf.OrderByDevice {
+		queues = conf.Count
+		queueSize = (queueSize + conf.Count - 1) / conf.Count
+	}
+	p := &flushPool{queues: make([]chan flushJob, queues), workers: conf.Count, stop: make(chan struct{})}
+	for i := range p.queues {
+		p.queues[i] = make(chan flushJob, queueSize)
+	}
+	return p
+}
+
+func (p *flushPool) start(w *WriteBuffer) {
+	p.wg.Add(p.workers)
+	for i := 0; i < p.workers; i++ {
+		go p.run(w, p.queues[i%len(p.queues)])
+	}
+}
+
+// halt - makes workers give up batches which keep failing, so shutdown is not blocked by storage
+func (p *flushPool) halt() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// close - stops workers after queued batches are handled, must be called by data handler
+func (p *flushPool) close() {
+	p.halt()
+	for _, q := range p.queues {
+		close(q)
+	}
+}
+
+func (p *flushPool) wait() {
+	p.wg.Wait()
+}
+
+func (p *flushPool) busy() bool {
+	return atomic.LoadInt32(&p.inFlight) > 0
+}
+
+func (p *flushPool) queueOf(hash uint32) int {
+	return int((hash >> 16) % uint32(len(p.queues)))
+}
+
+// split - divides batch and its acks between queues by device
+func (p *flushPool) split(data []m.Model, acks []pendingAck) ([][]m.Model, [][]pendingAck) {
+	if len(p.queues) == 1 {
+		return [][]m.Model{data}, [][]pendingAck{acks}
+	}
+	parts := make([][]m.Model, len(p.queues))
+	for i := range data {
+		q := p.queueOf(deviceHash(data[i]))
+		parts[q] = append(parts[q], data[i])
+	}
+	ackParts := make([][]pendingAck, len(p.queues))
+	for _, a := range acks {
+		q := p.queueOf(hashDevice(a.key.id))
+		ackParts[q] = append(ackParts[q], a)
+	}
+	return parts, ackParts
+}
+
+func (p *flushPool) run(w *WriteBuffer, queue chan flushJob) {
+	defer p.wg.Done()
+	for job := range queue {
+		metrics.FlushQueueDepth.Dec()
+		metrics.FlushInFlight.Inc()
+		atomic.AddInt32(&p.inFlight, 1)
+		written := p.write(w, job)
+		atomic.AddInt32(&p.inFlight, -1)
+		metrics.FlushInFlight.Dec()
+		// failed group is never completed, so its datapoints and all later ones stay in WAL
+		if written && atomic.AddInt32(&job.group.remaining, -1) == 0 {
+			w.completeFlush(job.group.seq, job.group.size)
+		}
+	}
+}
+
+// write - writes batch, batch which can't be written nor moved to dead letter store
+// is retried every flush interval until shutdown
+func (p *flushPool) write(w *WriteBuffer, job flushJob) bool {
+	data := job.data
+	for {
+		err := w.writeBatch(data, job.acks)
+		if err == nil {
+			return true
+		}
+		log.Println(err)
+		select {
+		case <-p.stop:
+			if w.wal != nil {
+				log.Printf("Batch of %v datapoints is left in WAL on shutdown", len(data))
+			} else {
+				log.Printf("Batch of %v datapoints is lost on shutdown", len(data))
+			}
+			failAcks(job.acks, ErrNotWritten)
+			return false
+		case <-time.After(w.flushInterval()):
+		}
+	}
+}
+
+// dispatch - swaps buffer and queues its contents for workers, blocks while queue is full
+func (w *WriteBuffer) dispatch() {
+	if len(w.Buff) == 0 {
+		if !w.workers.busy() {
+			w.health.recordFlush(nil)
+		}
+		return
+	}
+	data, acks := w.Buff, w.acks
+	w.Buff = make([]m.Model, 0, w.Conf.BufMaxSize)
+	w.acks = nil
+	w.reportLength()
+
+	group := &flushGroup{seq: w.nextSeq(), size: len(data)}
+	parts, ackParts := w.workers.split(data, acks)
+	for i := range parts {
+		if len(parts[i]) > 0 {
+			group.remaining++
+		}
+	}
+	for i := range parts {
+		if len(parts[i]) == 0 {
+			continue
+		}
+		metrics.FlushQueueDepth.Inc()
+		w.workers.queues[i] <- flushJob{data: parts[i], acks: ackParts[i], group: group}
+	}
+}
+
+func (w *WriteBuffer) nextSeq() uint64 {
+	return atomic.AddUint64(&w.seq, 1) - 1
+}
+
+// completeFlush - records flush of buffer swap with given sequence number; swaps may
+// complete out of order, WAL records are committed only for continuous prefix of swaps
+func (w *WriteBuffer) completeFlush(seq uint64, n int) {
+	w.drain.record(n, time.Now())
+	w.commitMu.Lock()
+	defer w.commitMu.Unlock()
+	if w.completed == nil {
+		w.completed = make(map[uint64]int)
+	}
+	w.completed[seq] = n
+	for {
+		n, ok := w.completed[w.committed]
+		if !ok {
+			return
+		}
+		delete(w.completed, w.committed)
+		w.committed++
+		if w.wal != nil && n > 0 {
+			if err := w.wal.Commit(n); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -9,7 +9,11 @@ import (
 
 	cfg "github.com/qwlt/gmcollector/app/config"
 	db "github.com/qwlt/gmcollector/app/db"
+	"github.com/qwlt/gmcollector/app/deadletter"
+	"github.com/qwlt/gmcollector/app/metrics"
 	m "github.com/qwlt/gmcollector/app/models"
+	"github.com/qwlt/gmcollector/app/rejectlog"
+	"github.com/qwlt/gmcollector/app/wal"
 	"github.com/spf13/viper"
 )
 
@@ -21,54 +25,229 @@ type StorageInterface interface {
 	Write(data []m.Model) error
 }
 
+// Observer - receives every datapoint accepted into buffer, must not block
+type Observer interface {
+	Observe(datapoint m.Model)
+}
+
 type WriteBuffer struct {
 	mu       sync.Mutex
 	Buff     []m.Model
 	dataChan chan m.Model
 	stopChan chan int64
-	Storage  StorageInterface
-	Conf     WBufferConfig
+	// closed by Shutdown, interrupts backoff between write attempts
+	stopped    chan struct{}
+	stopOnce   sync.Once
+	Storage    StorageInterface
+	Conf       WBufferConfig
+	wal        *wal.WAL
+	deadLetter *deadletter.Store
+	rejectLog  *rejectlog.Log
+	health     healthState
+	latest     *LatestCache
+	observers  []Observer
+	drain      drainMeter
+	limits     bufferLimits
+	// completion handles of write-through datapoints in Buff
+	acks    []pendingAck
+	workers *flushPool
+	shards  []*WriteBuffer
+	// last buffer length added to shared gauge
+	reportedLength int
+	// sequence numbers of buffer swaps, WAL is committed in their order
+	seq       uint64
+	commitMu  sync.Mutex
+	committed uint64
+	completed map[uint64]int
 }
 
 // BufMaxSize - max amount of records inside a buffer before it will be flushed to permanent storage
-// WriteTimeout - max duration after last buffer flush, after it expires buffer will be forced to flush
+// WriteTimeout - max duration in seconds after last buffer flush, after it expires buffer will be forced to flush
+// MaxBytes - optional max approximate size of a batch in bytes, see DatapointSize
+// MaxAge - optional max time the oldest datapoint waits in buffer, may be less than a second, buffer kept after failed flush is retried after it
 // TableName - identifier in permanent storage which is used to save record(real tablename inside SQL storages)
+// WAL - optional write-ahead log, datapoints are appended to it before acknowledgement
+// Retry - policy of retrying failed writes
+// DeadLetter - optional store for batches which failed all write attempts
+// RejectLog - optional log of datapoints rejected by storage because of their content
+// Admission - policy of accepting datapoints when buffer channel is full
+// Workers - optional goroutines writing batches concurrently with collection
+// Shards - number of independent buffers datapoints are spread to by DeviceID, every shard has
+// own channel, buffer of BufMaxSize, flush ticker, workers and WAL subdirectory; 0 or 1 disables sharding
+// SyncTimeout - max time write-through requests wait until their datapoints are committed, 10s by default
+// WarmWindow - latest values cache is warmed on start with values stored within this window, 24h by default
+// Writer - storage writer implementation: `insert` (multi-row INSERT, default) or `copy` (COPY protocol)
+// Conflict - handling of datapoints with already stored (DeviceID, Timestamp): `ignore` (default), `update` or `reject`
+// RowCountMismatch - handling of writes which affected other number of rows than batch size:
+// `retry` (default), `commit` or `deadletter`; under `ignore` conflict only more rows than batch size is a mismatch
 type WBufferConfig struct {
-	BufMaxSize   int    `mapstructure:"bufMaxSize"`
-	WriteTimeout int    `mapstructure:"writeTimeout"`
-	TableName    string `mapstructure:"tableName"`
+	BufMaxSize       int               `mapstructure:"bufMaxSize"`
+	WriteTimeout     int               `mapstructure:"writeTimeout"`
+	MaxBytes         int               `mapstructure:"maxBytes"`
+	MaxAge           time.Duration     `mapstructure:"maxAge"`
+	TableName        string            `mapstructure:"tableName"`
+	Writer           string            `mapstructure:"writer"`
+	Conflict         string            `mapstructure:"conflict"`
+	RowCountMismatch string            `mapstructure:"rowCountMismatch"`
+	WAL              wal.Config        `mapstructure:"wal"`
+	Retry            RetryConfig       `mapstructure:"retry"`
+	DeadLetter       deadletter.Config `mapstructure:"deadLetter"`
+	RejectLog        rejectlog.Config  `mapstructure:"rejectLog"`
+	Admission        AdmissionConfig   `mapstructure:"admission"`
+	Workers          WorkersConfig     `mapstructure:"workers"`
+	Shards           int               `mapstructure:"shards"`
+	SyncTimeout      time.Duration     `mapstructure:"syncTimeout"`
+	WarmWindow       time.Duration     `mapstructure:"warmWindow"`
 }
 
+// AddDatapoint - puts datapoint into buffer, if WAL is enabled datapoint is
+// logged first, so appends are serialized to keep log order equal to buffer order
 func (w *WriteBuffer) AddDatapoint(datapoint m.Model) error {
-	select {
-	case w.dataChan <- datapoint:
-		return nil
-	case <-time.After(time.Second * 1):
+	return w.AddDatapointPriority(datapoint, PriorityNormal)
+}
 
-		return TimeoutError
+// AddDatapointPriority - same as AddDatapoint, priority is considered by `shed` admission policy
+func (w *WriteBuffer) AddDatapointPriority(datapoint m.Model, priority Priority) error {
+	if len(w.shards) > 0 {
+		return w.shardFor(datapoint).AddDatapointPriority(datapoint, priority)
+	}
+	if w.wal == nil {
+		return w.addLocked(datapoint, priority, nil)
 	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.addLocked(datapoint, priority, nil)
+}
+
+// AddDatapoints - puts datapoints into buffer one after another without interleaving
+// with other producers when WAL is enabled, returns number of accepted datapoints
+func (w *WriteBuffer) AddDatapoints(datapoints []m.Model) (int, error) {
+	return w.AddDatapointsPriority(datapoints, PriorityNormal)
+}
 
+// AddDatapointsPriority - same as AddDatapoints, priority is considered by `shed` admission policy
+func (w *WriteBuffer) AddDatapointsPriority(datapoints []m.Model, priority Priority) (int, error) {
+	if len(w.shards) > 0 {
+		for i := range datapoints {
+			if err := w.shardFor(datapoints[i]).AddDatapointPriority(datapoints[i], priority); err != nil {
+				return i, err
+			}
+		}
+		return len(datapoints), nil
+	}
+	if w.wal != nil {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+	}
+	for i := range datapoints {
+		if err := w.addLocked(datapoints[i], priority, nil); err != nil {
+			return i, err
+		}
+	}
+	return len(datapoints), nil
+}
+
+// addLocked - logs datapoint and sends it to data handler, ack is resolved after datapoint is written
+func (w *WriteBuffer) addLocked(datapoint m.Model, priority Priority, ack *Ack) error {
+	if w.wal != nil {
+		if err := w.wal.Append(datapoint); err != nil {
+			return err
+		}
+	}
+	item := datapoint
+	if ack != nil {
+		item = &syncDatapoint{Model: datapoint, ack: ack}
+	}
+	if err := w.send(item, priority); err != nil {
+		if w.wal != nil {
+			if walErr := w.wal.Discard(); walErr != nil {
+				log.Println(walErr)
+			}
+		}
+		return err
+	}
+	if w.latest != nil {
+		w.latest.Update(datapoint)
+	}
+	for _, o := range w.observers {
+		o.Observe(datapoint)
+	}
+	return nil
 }
 
+// FlushBuffer - writes buffer to storage synchronously, see writeBatch;
+// buffer is kept if it could not be written nor moved to dead letter store
 func (w *WriteBuffer) FlushBuffer() error {
-	// log.Printf("Flushing at %v", time.Now())
-	// start := time.Now()
-	// log.Println("Flushing buffer")
-	err := w.Storage.Write(w.Buff)
-	if err != nil {
-		return fmt.Errorf("cant write buffer")
+	if len(w.shards) > 0 {
+		return w.flushShards()
 	}
+	defer w.reportLength()
+	if err := w.writeBatch(w.Buff, w.acks); err != nil {
+		return err
+	}
+	w.completeFlush(w.nextSeq(), len(w.Buff))
 	w.Buff = nil
-	// log.Printf("Flushing done in %v", time.Since(start))
+	w.acks = nil
 	return nil
+}
 
+// writeBatch - writes datapoints to storage with retries, datapoints rejected by storage are
+// isolated and moved to reject log, the rest is committed; datapoints which failed all attempts
+// are moved to dead letter store if it is configured, otherwise error is returned and acks are left pending
+func (w *WriteBuffer) writeBatch(data []m.Model, acks []pendingAck) error {
+	start := time.Now()
+	defer func() {
+		metrics.FlushDuration.Observe(time.Since(start).Seconds())
+	}()
+	// duplicates inside one batch would fail `ON CONFLICT DO UPDATE` and are never wanted
+	batch, duplicates := Deduplicate(data, w.Conf.Conflict == ConflictUpdate)
+	if duplicates > 0 {
+		metrics.DuplicatesDropped.Add(float64(duplicates))
+	}
+	if len(batch) > 0 {
+		metrics.WriteBatchSize.Observe(float64(len(batch)))
+	}
+	attempts, pending, rejected, err := w.writeWithRetry(batch)
+	w.health.recordFlush(err)
+	if len(rejected) > 0 {
+		metrics.RejectedRows.Add(float64(len(rejected)))
+		w.logRejected(rejected)
+	}
+	if err != nil {
+		metrics.FlushErrors.Inc()
+		if w.deadLetter == nil {
+			return fmt.Errorf("cant write buffer: %w", err)
+		}
+		id, dlErr := w.deadLetter.Put(pending, attempts, err)
+		if dlErr != nil {
+			return fmt.Errorf("cant write buffer: %w, cant move it to dead letter store: %v", err, dlErr)
+		}
+		metrics.DeadLetterBatches.Inc()
+		log.Printf("Batch of %v datapoints moved to dead letter store as %v: %v", len(pending), id, err)
+	}
+	resolveAcks(acks, rejected, pending, err)
+	return nil
 }
 
 // RunDataHandler run as goroutine and collect values into write buffer
-// flush buffer after overflow or after timeout
+// flush buffer after overflow of BufMaxSize or MaxBytes, when the oldest datapoint
+// reaches MaxAge or after timeout, timeout is counted from the last flush;
+// with flush workers buffer is handed over to them instead of being written in place
 func (w *WriteBuffer) RunDataHandler() {
+	if len(w.shards) > 0 {
+		w.runShards()
+		return
+	}
 	log.Println("Running data handler")
-	ticker := time.NewTicker(time.Duration(w.Conf.WriteTimeout) * time.Second)
+	w.health.setRunning(true)
+	defer w.health.setRunning(false)
+	if w.workers != nil {
+		w.workers.start(w)
+		defer w.workers.close()
+	}
+	ticker := time.NewTicker(w.flushInterval())
+	defer ticker.Stop()
+	defer w.limits.stop()
 OuterLoop:
 	for {
 		select {
@@ -76,36 +255,196 @@ OuterLoop:
 			log.Println("write buffer recieve stop chan")
 			break OuterLoop
 
-		case m := <-w.dataChan:
+		case datapoint := <-w.dataChan:
+			var ack *Ack
+			if sync, ok := datapoint.(*syncDatapoint); ok {
+				datapoint, ack = sync.Model, sync.ack
+			}
+			size := DatapointSize(datapoint)
 			// p.mu.Lock()
-			if len(w.Buff) == w.Conf.BufMaxSize {
-				w.FlushBuffer()
+			if len(w.Buff) >= w.Conf.BufMaxSize ||
+				w.Conf.MaxBytes > 0 && len(w.Buff) > 0 && w.limits.bytes+size > w.Conf.MaxBytes {
+				w.flush()
+				ticker.Reset(w.flushInterval())
 			}
 			// p.mu.Unlock()
-			w.Buff = append(w.Buff, m)
+			w.Buff = append(w.Buff, datapoint)
+			if ack != nil {
+				key, _ := keyOf(datapoint)
+				w.acks = append(w.acks, pendingAck{key: key, ack: ack})
+			}
+			w.limits.added(size, w.Conf.MaxAge)
+			w.reportLength()
+
+		case <-w.limits.ageC():
+			w.flush()
+			ticker.Reset(w.flushInterval())
 
 		case <-ticker.C:
-			// w.mu.Lock()
-			w.FlushBuffer()
-			// w.mu.Unlock()
+			w.flush()
 		}
 
 	}
 
 }
 
+func (w *WriteBuffer) flush() {
+	defer func() { w.limits.flushed(len(w.Buff) == 0, w.Conf.MaxAge) }()
+	if w.workers != nil {
+		w.dispatch()
+		return
+	}
+	if err := w.FlushBuffer(); err != nil {
+		log.Println(err)
+	}
+}
+
+// Shutdown - stops data handler, flush workers finish queued batches in background,
+// Close waits for them
 func (w *WriteBuffer) Shutdown() {
+	if len(w.shards) > 0 {
+		for _, s := range w.shards {
+			s.Shutdown()
+		}
+		return
+	}
+	w.stopOnce.Do(func() {
+		if w.stopped != nil {
+			close(w.stopped)
+		}
+	})
+	if w.workers != nil {
+		w.workers.halt()
+	}
 	w.stopChan <- 1
 }
 
-func CreateWriteBuffer(config *WBufferConfig) (*WriteBuffer, error) {
-	// TODO try different buffer sizes
-	buf := WriteBuffer{}
-	buf.Conf = *config
-	buf.Buff = make([]m.Model, 0, buf.Conf.BufMaxSize)
-	buf.dataChan = make(chan m.Model, buf.Conf.BufMaxSize)
-	buf.stopChan = make(chan int64)
+// replayBatch - writes batch read from WAL the same way as live flushes: retried datapoints
+// logged twice are deduplicated, rejected rows are isolated and failed batch is moved to dead
+// letter store, so a single bad datapoint can't block startup; error keeps the rest in WAL
+func (w *WriteBuffer) replayBatch(data []m.Model) error {
+	return w.writeBatch(data, nil)
+}
 
+// ReplayWAL - writes datapoints left in WAL by previous run to storage bypassing buffer,
+// including WAL of every shard and of shards removed since then, must be called before RunDataHandler
+func (w *WriteBuffer) ReplayWAL() error {
+	if w.wal == nil {
+		return nil
+	}
+	n, err := w.wal.Replay(w.Conf.BufMaxSize, w.replayBatch)
+	if n > 0 {
+		log.Printf("Replayed %v datapoints from WAL", n)
+	}
+	if err != nil {
+		return err
+	}
+	for i, s := range w.shards {
+		if err := s.ReplayWAL(); err != nil {
+			return fmt.Errorf("shard %v: %w", i, err)
+		}
+	}
+	return w.replayOrphanShards()
+}
+
+func (w *WriteBuffer) ChannelLength() int {
+	if len(w.shards) > 0 {
+		n := 0
+		for _, s := range w.shards {
+			n += s.ChannelLength()
+		}
+		return n
+	}
+	return len(w.dataChan)
+}
+
+func (w *WriteBuffer) ChannelCapacity() int {
+	if len(w.shards) > 0 {
+		n := 0
+		for _, s := range w.shards {
+			n += s.ChannelCapacity()
+		}
+		return n
+	}
+	return cap(w.dataChan)
+}
+
+// reportLength - buffer length gauge is shared by shards, so every buffer reports its change
+func (w *WriteBuffer) reportLength() {
+	metrics.BufferLength.Add(float64(len(w.Buff) - w.reportedLength))
+	w.reportedLength = len(w.Buff)
+}
+
+// DeadLetter - returns dead letter store or nil if it is disabled
+func (w *WriteBuffer) DeadLetter() *deadletter.Store {
+	return w.deadLetter
+}
+
+// ReinjectDeadLetter - puts datapoints of dead letter batch back into buffer,
+// datapoints which could not be accepted are kept in the store
+func (w *WriteBuffer) ReinjectDeadLetter(id string) (int, error) {
+	if w.deadLetter == nil {
+		return 0, deadletter.ErrBatchNotFound
+	}
+	batch, err := w.deadLetter.Load(id)
+	if err != nil {
+		return 0, err
+	}
+	for i := range batch.Datapoints {
+		if err := w.AddDatapoint(batch.Datapoints[i]); err != nil {
+			batch.Datapoints = batch.Datapoints[i:]
+			if updErr := w.deadLetter.Update(batch); updErr != nil {
+				log.Println(updErr)
+			}
+			return i, err
+		}
+	}
+	return len(batch.Datapoints), w.deadLetter.Remove(id)
+}
+
+// AddObserver - registers observer of accepted datapoints, call before ingestion starts
+func (w *WriteBuffer) AddObserver(o Observer) {
+	w.observers = append(w.observers, o)
+	for _, s := range w.shards {
+		s.AddObserver(o)
+	}
+}
+
+// Latest - returns cache of last value per device
+func (w *WriteBuffer) Latest() *LatestCache {
+	return w.latest
+}
+
+// Close - waits for flush workers and releases resources held by buffer, call after final flush
+func (w *WriteBuffer) Close() error {
+	for i, s := range w.shards {
+		if err := s.closeOwn(); err != nil {
+			log.Printf("shard %v: %v", i, err)
+		}
+	}
+	if w.rejectLog != nil {
+		if err := w.rejectLog.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	return w.closeOwn()
+}
+
+// closeOwn - waits for flush workers and closes WAL, resources shared by shards are closed by Close
+func (w *WriteBuffer) closeOwn() error {
+	if w.workers != nil {
+		w.workers.wait()
+	}
+	failAcks(w.acks, ErrNotWritten)
+	w.acks = nil
+	w.failQueuedAcks()
+	if w.wal == nil {
+		return nil
+	}
+	return w.wal.Close()
+}
+
+func CreateWriteBuffer(config *WBufferConfig) (*WriteBuffer, error) {
 	ConnPool := db.GetDB()
 	var tablename string
 	if config.TableName == "" {
@@ -114,9 +453,96 @@ func CreateWriteBuffer(config *WBufferConfig) (*WriteBuffer, error) {
 		tablename = config.TableName
 	}
 
-	writerConf := &PGWriterConfig{Pool: ConnPool, TableName: tablename}
-	buf.Storage = NewPGWriter(writerConf)
-	return &buf, nil
+	if config.Conflict == "" {
+		config.Conflict = ConflictIgnore
+	}
+	if err := validateConflict(config.Conflict); err != nil {
+		return nil, err
+	}
+	if config.RowCountMismatch == "" {
+		config.RowCountMismatch = RowCountRetry
+	}
+	if err := validateRowCountPolicy(config.RowCountMismatch); err != nil {
+		return nil, err
+	}
+	if err := config.Admission.validate(); err != nil {
+		return nil, err
+	}
+	workers := config.Workers.Count
+	if config.Shards > 1 {
+		workers *= config.Shards
+	}
+	if ConnPool != nil && workers > int(ConnPool.Config().MaxConns) {
+		log.Printf("Pool allows %v connections, %v flush workers will wait for them", ConnPool.Config().MaxConns, workers)
+	}
+	writerConf := &PGWriterConfig{Pool: ConnPool, TableName: tablename, Conflict: config.Conflict, RowCountMismatch: config.RowCountMismatch}
+	var storage StorageInterface
+	switch config.Writer {
+	case "", WriterInsert:
+		storage = NewPGWriter(writerConf)
+	case WriterCopy:
+		storage = NewPGCopyWriter(writerConf)
+	default:
+		return nil, fmt.Errorf("unknown writer `%v`", config.Writer)
+	}
+	buf := NewWriteBuffer(config, storage)
+	buf.Conf.TableName = tablename
+	if config.WAL.Enabled {
+		l, err := wal.Open(config.WAL)
+		if err != nil {
+			return nil, err
+		}
+		buf.wal = l
+	}
+	if config.DeadLetter.Enabled {
+		store, err := deadletter.Open(config.DeadLetter)
+		if err != nil {
+			return nil, err
+		}
+		buf.deadLetter = store
+	}
+	if config.RejectLog.Enabled {
+		l, err := rejectlog.Open(config.RejectLog)
+		if err != nil {
+			return nil, err
+		}
+		buf.rejectLog = l
+	}
+	// WAL of sharded buffer itself is only replayed, it may hold datapoints from run without shards
+	for i, shard := range buf.shards {
+		shard.Conf.TableName = tablename
+		shard.deadLetter = buf.deadLetter
+		shard.rejectLog = buf.rejectLog
+		if config.WAL.Enabled {
+			l, err := wal.Open(shardWALConfig(config.WAL, i))
+			if err != nil {
+				return nil, err
+			}
+			shard.wal = l
+		}
+	}
+	return buf, nil
+}
+
+// NewWriteBuffer - creates buffer on top of given storage without optional WAL and dead letter store
+func NewWriteBuffer(config *WBufferConfig, storage StorageInterface) *WriteBuffer {
+	// TODO try different buffer sizes
+	buf := &WriteBuffer{}
+	buf.Conf = *config
+	buf.Buff = make([]m.Model, 0, buf.Conf.BufMaxSize)
+	buf.dataChan = make(chan m.Model, buf.Conf.BufMaxSize)
+	buf.stopChan = make(chan int64)
+	buf.stopped = make(chan struct{})
+	buf.Storage = storage
+	buf.latest = NewLatestCache()
+	if buf.Conf.Shards > 1 {
+		buf.shards = newShards(config, storage, buf.latest)
+		return buf
+	}
+	if buf.Conf.Workers.Count > 0 {
+		buf.workers = newFlushPool(buf.Conf.Workers)
+	}
+	return buf
 }
 
 func GetBuffer() (*WriteBuffer, error) {
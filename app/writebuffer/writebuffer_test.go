@@ -1,11 +1,26 @@
 package writebuffer
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/qwlt/gmcollector/app/deadletter"
 	"github.com/qwlt/gmcollector/app/models"
+	"github.com/qwlt/gmcollector/app/rejectlog"
+	"github.com/qwlt/gmcollector/app/wal"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
@@ -62,3 +77,496 @@ func DatapointWriter(p *WriteBuffer, v float64, wg *sync.WaitGroup) {
 	p.AddDatapoint(models.Measurement{Value: v})
 	wg.Done()
 }
+
+func TestFlushMovesFailedBatchToDeadLetter(t *testing.T) {
+	store, err := deadletter.Open(deadletter.Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	storage := &FailingStorage{Err: errors.New("connection refused")}
+	var pool WriteBuffer
+	pool.Conf = WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, Retry: RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond}}
+	pool.Storage = storage
+	pool.deadLetter = store
+	now := time.Now()
+	pool.Buff = []models.Model{models.Measurement{Value: 1, Timestamp: now}, models.Measurement{Value: 2, Timestamp: now.Add(time.Second)}}
+
+	require.NoError(t, pool.FlushBuffer())
+	require.Equal(t, 3, storage.Attempts)
+	require.Empty(t, pool.Buff)
+
+	batches, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, 2, batches[0].Count)
+	require.Equal(t, "connection refused", batches[0].Error)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	conf := RetryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	require.Equal(t, 100*time.Millisecond, conf.Backoff(1))
+	require.Equal(t, 400*time.Millisecond, conf.Backoff(3))
+	require.Equal(t, time.Second, conf.Backoff(10))
+
+	conf.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := conf.Backoff(2)
+		require.True(t, d >= 100*time.Millisecond && d <= 200*time.Millisecond, d)
+	}
+}
+
+func TestLatestCacheKeepsNewestValue(t *testing.T) {
+	cache := NewLatestCache()
+	id := uuid.New()
+	now := time.Now()
+	cache.Update(models.Measurement{DeviceID: id, Value: 2, Timestamp: now})
+	cache.Update(models.Measurement{DeviceID: id, Value: 1, Timestamp: now.Add(-time.Minute)})
+
+	v, ok := cache.Get(id)
+	require.True(t, ok)
+	require.Equal(t, 2.0, v.Value)
+
+	silent := uuid.New()
+	cache.Update(&models.Measurement{DeviceID: silent, Value: 3, Timestamp: now.Add(-2 * time.Hour)})
+	stale := cache.Stale(time.Hour, now)
+	require.Len(t, stale, 1)
+	require.Equal(t, silent, stale[0].DeviceID)
+}
+
+func TestDeduplicate(t *testing.T) {
+	id := uuid.New()
+	ts := time.Date(2021, 11, 1, 10, 0, 0, 0, time.UTC)
+	data := []models.Model{
+		models.Measurement{DeviceID: id, Timestamp: ts, Value: 1},
+		models.Measurement{DeviceID: uuid.New(), Timestamp: ts, Value: 2},
+		models.Measurement{DeviceID: id, Timestamp: ts.Add(time.Second), Value: 3},
+		// differs below postgres precision
+		&models.Measurement{DeviceID: id, Timestamp: ts.Add(100 * time.Nanosecond), Value: 4},
+	}
+
+	unique, dropped := Deduplicate(data, false)
+	require.Equal(t, 1, dropped)
+	require.Len(t, unique, 3)
+	require.Equal(t, 1.0, unique[0].(models.Measurement).Value)
+
+	unique, _ = Deduplicate(data, true)
+	require.Len(t, unique, 3)
+	require.Equal(t, 4.0, unique[0].(*models.Measurement).Value)
+	require.Equal(t, 3.0, unique[2].(models.Measurement).Value)
+
+	same, dropped := Deduplicate(data[:3], true)
+	require.Equal(t, 0, dropped)
+	require.Equal(t, data[:3], same)
+}
+
+func TestFlushDeduplicatesBatch(t *testing.T) {
+	storage := &RecordingStorage{}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10}, storage)
+	m := models.Measurement{DeviceID: uuid.New(), Timestamp: time.Now(), Value: 1}
+	buf.Buff = []models.Model{m, m, m}
+	require.NoError(t, buf.FlushBuffer())
+	require.Len(t, storage.Batches, 1)
+	require.Len(t, storage.Batches[0], 1)
+}
+
+func TestReplayWALDeduplicatesBatch(t *testing.T) {
+	conf := wal.Config{Enabled: true, Dir: t.TempDir(), Fsync: wal.FsyncNone}
+	l, err := wal.Open(conf)
+	require.NoError(t, err)
+	m := models.Measurement{DeviceID: uuid.New(), Timestamp: time.Now().UTC(), Value: 1}
+	require.NoError(t, l.Append(m))
+	require.NoError(t, l.Append(m))
+	require.NoError(t, l.Close())
+
+	storage := &RecordingStorage{}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, Conflict: ConflictUpdate}, storage)
+	buf.wal, err = wal.Open(conf)
+	require.NoError(t, err)
+	defer buf.Close()
+	require.NoError(t, buf.ReplayWAL())
+	require.Len(t, storage.Batches, 1)
+	require.Len(t, storage.Batches[0], 1)
+}
+
+func TestReplayWALIsolatesRejectedRows(t *testing.T) {
+	conf := wal.Config{Enabled: true, Dir: t.TempDir(), Fsync: wal.FsyncNone}
+	l, err := wal.Open(conf)
+	require.NoError(t, err)
+	now := time.Now().UTC()
+	for _, v := range []float64{1, -1, 2} {
+		require.NoError(t, l.Append(models.Measurement{DeviceID: uuid.New(), Timestamp: now, Value: v}))
+	}
+	require.NoError(t, l.Close())
+
+	storage := &RejectingStorage{Bad: -1}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10}, storage)
+	buf.wal, err = wal.Open(conf)
+	require.NoError(t, err)
+	require.NoError(t, buf.ReplayWAL())
+	require.Len(t, storage.Written, 2)
+	require.NoError(t, buf.Close())
+
+	// batch failing for other reasons goes to dead letter store instead of blocking startup
+	l, err = wal.Open(conf)
+	require.NoError(t, err)
+	require.NoError(t, l.Append(models.Measurement{DeviceID: uuid.New(), Timestamp: now, Value: 1}))
+	require.NoError(t, l.Close())
+	store, err := deadletter.Open(deadletter.Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	buf = NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, Retry: RetryConfig{MaxAttempts: 1}},
+		&FailingStorage{Err: errors.New("connection refused")})
+	buf.deadLetter = store
+	buf.wal, err = wal.Open(conf)
+	require.NoError(t, err)
+	defer buf.Close()
+	require.NoError(t, buf.ReplayWAL())
+	batches, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+}
+
+func TestBuildConflictQueryString(t *testing.T) {
+	require.Equal(t, "INSERT INTO m (uid, datetime) VALUES ($1, $2),($3, $4);", BuildQueryString("m", []string{"uid", "datetime"}, 2))
+	require.Equal(t, "INSERT INTO m (uid, datetime) VALUES ($1, $2) ON CONFLICT (uid, datetime) DO NOTHING;",
+		BuildConflictQueryString("m", []string{"uid", "datetime"}, 1, ConflictIgnore))
+}
+
+func TestFlushIsolatesRejectedRows(t *testing.T) {
+	dir := t.TempDir()
+	rejects, err := rejectlog.Open(rejectlog.Config{Enabled: true, Path: filepath.Join(dir, "rejected.jsonl")})
+	require.NoError(t, err)
+	storage := &RejectingStorage{Bad: -1}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10}, storage)
+	buf.rejectLog = rejects
+	defer buf.Close()
+
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		v := float64(i)
+		if i == 2 || i == 5 {
+			v = -1
+		}
+		buf.Buff = append(buf.Buff, models.Measurement{DeviceID: uuid.New(), Timestamp: now, Value: v})
+	}
+	require.NoError(t, buf.FlushBuffer())
+	require.Len(t, storage.Written, 6)
+	require.Empty(t, buf.Buff)
+
+	raw, err := os.ReadFile(filepath.Join(dir, "rejected.jsonl"))
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	require.Len(t, lines, 2)
+	var entry rejectlog.Entry
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, "22P02", entry.Code)
+	require.Equal(t, -1.0, entry.Datapoint.Value)
+}
+
+func TestIsRowError(t *testing.T) {
+	require.True(t, IsRowError(fmt.Errorf("write: %w", &pgconn.PgError{Code: "23505"})))
+	require.False(t, IsRowError(&pgconn.PgError{Code: "57P01"}))
+	require.False(t, IsRowError(errors.New("connection refused")))
+}
+
+func TestRowCountMismatchPolicy(t *testing.T) {
+	require.NoError(t, checkRowCount(RowCountRetry, 3, 3))
+	require.NoError(t, checkRowCount(RowCountCommit, 3, 2))
+	err := checkRowCount(RowCountDeadLetter, 3, 2)
+	var mismatch *RowCountMismatchError
+	require.True(t, errors.As(err, &mismatch))
+	require.Equal(t, int64(3), mismatch.Expected)
+	require.Equal(t, int64(2), mismatch.Actual)
+
+	// skipped conflicts are expected under `ignore`, extra rows are not
+	require.NoError(t, checkInsertedRows(RowCountRetry, ConflictIgnore, 3, 1))
+	require.Error(t, checkInsertedRows(RowCountRetry, ConflictIgnore, 3, 4))
+	require.Error(t, checkInsertedRows(RowCountRetry, ConflictUpdate, 3, 1))
+}
+
+func TestRowCountMismatchMovedToDeadLetterWithoutRetries(t *testing.T) {
+	store, err := deadletter.Open(deadletter.Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	storage := &FailingStorage{Err: &RowCountMismatchError{Expected: 1, Actual: 0}}
+	var pool WriteBuffer
+	pool.Conf = WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, RowCountMismatch: RowCountDeadLetter,
+		Retry: RetryConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond}}
+	pool.Storage = storage
+	pool.deadLetter = store
+	pool.Buff = []models.Model{models.Measurement{Value: 1}}
+
+	require.NoError(t, pool.FlushBuffer())
+	require.Equal(t, 1, storage.Attempts)
+
+	batches, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+	require.Equal(t, 1, batches[0].Attempts)
+}
+
+func TestAdmissionRejectsWithoutBlocking(t *testing.T) {
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 1, WriteTimeout: 10, Admission: AdmissionConfig{Policy: AdmissionReject}}, &MockStorage{})
+	require.NoError(t, buf.AddDatapoint(models.Measurement{Value: 1}))
+	start := time.Now()
+	err := buf.AddDatapoint(models.Measurement{Value: 2})
+	require.ErrorIs(t, err, ErrBufferFull)
+	require.True(t, IsOverloaded(err))
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	buf.Conf.Admission = AdmissionConfig{Timeout: 10 * time.Millisecond}
+	require.ErrorIs(t, buf.AddDatapoint(models.Measurement{Value: 3}), TimeoutError)
+}
+
+func TestRetryAfterFollowsDrainRate(t *testing.T) {
+	require.Equal(t, defaultRetryAfter, retryAfter(100, 0))
+	require.Equal(t, time.Second, retryAfter(0, 50))
+	require.Equal(t, 3*time.Second, retryAfter(250, 100))
+	require.Equal(t, maxRetryAfter, retryAfter(1000000, 10))
+
+	var d drainMeter
+	now := time.Now()
+	d.record(100, now)
+	d.record(100, now.Add(time.Second))
+	require.Equal(t, 100.0, d.get())
+	d.record(400, now.Add(2*time.Second))
+	require.InDelta(t, 190.0, d.get(), 0.001)
+}
+
+func TestFlushWorkersWriteConcurrently(t *testing.T) {
+	storage := &SlowStorage{Delay: 20 * time.Millisecond}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, Workers: WorkersConfig{Count: 4}}, storage)
+	go buf.RunDataHandler()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: uuid.New(), Timestamp: time.Now(), Value: float64(i)}))
+	}
+	require.Eventually(t, func() bool { return buf.ChannelLength() == 0 }, time.Second, time.Millisecond)
+	buf.Shutdown()
+	require.NoError(t, buf.FlushBuffer())
+	require.NoError(t, buf.Close())
+
+	require.Len(t, storage.Written, 100)
+	require.Greater(t, storage.MaxActive, 1)
+}
+
+func TestFlushWorkersKeepDeviceOnOneQueue(t *testing.T) {
+	pool := newFlushPool(WorkersConfig{Count: 4, OrderByDevice: true})
+	devices := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	var data []models.Model
+	var acks []pendingAck
+	for i := 0; i < 30; i++ {
+		data = append(data, models.Measurement{DeviceID: devices[i%3], Value: float64(i)})
+		key, _ := keyOf(data[i])
+		acks = append(acks, pendingAck{key: key, ack: newAck()})
+	}
+	seen := make(map[uuid.UUID]int)
+	parts, ackParts := pool.split(data, acks)
+	for q, part := range parts {
+		last := -1.0
+		for _, d := range part {
+			v := d.(models.Measurement)
+			if prev, ok := seen[v.DeviceID]; ok {
+				require.Equal(t, prev, q)
+			}
+			seen[v.DeviceID] = q
+			require.Greater(t, v.Value, last)
+			last = v.Value
+		}
+	}
+	require.Len(t, seen, 3)
+	for q, part := range ackParts {
+		for _, a := range part {
+			require.Equal(t, seen[a.key.id], q)
+		}
+	}
+}
+
+func TestCompleteFlushCommitsInOrder(t *testing.T) {
+	var buf WriteBuffer
+	first, second := buf.nextSeq(), buf.nextSeq()
+	buf.completeFlush(second, 5)
+	require.Equal(t, uint64(0), buf.committed)
+	buf.completeFlush(first, 3)
+	require.Equal(t, uint64(2), buf.committed)
+	require.Empty(t, buf.completed)
+}
+
+func TestShardsKeepDeviceInOneShard(t *testing.T) {
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 100, WriteTimeout: 10, Shards: 4}, &MockStorage{})
+	require.Equal(t, 4, buf.Shards())
+	require.Equal(t, 400, buf.ChannelCapacity())
+
+	devices := make([]uuid.UUID, 20)
+	for i := range devices {
+		devices[i] = uuid.New()
+	}
+	for i := 0; i < 60; i++ {
+		require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: devices[i%20], Value: float64(i)}))
+	}
+	require.Equal(t, 60, buf.ChannelLength())
+	used := 0
+	for _, s := range buf.shards {
+		if s.ChannelLength() > 0 {
+			used++
+		}
+		for s.ChannelLength() > 0 {
+			v := (<-s.dataChan).(models.Measurement)
+			require.Same(t, s, buf.shardFor(v))
+		}
+	}
+	require.Greater(t, used, 1)
+}
+
+func TestShardsFlushEverything(t *testing.T) {
+	storage := &SlowStorage{}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, Shards: 3}, storage)
+	go buf.RunDataHandler()
+	for i := 0; i < 200; i++ {
+		require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: uuid.New(), Timestamp: time.Now(), Value: float64(i)}))
+	}
+	require.Eventually(t, func() bool { return buf.ChannelLength() == 0 }, time.Second, time.Millisecond)
+	buf.Shutdown()
+	require.NoError(t, buf.FlushBuffer())
+	require.NoError(t, buf.Close())
+	require.Len(t, storage.Written, 200)
+	require.True(t, buf.Latest().Len() > 0)
+}
+
+func TestReplayWALOfRemovedShard(t *testing.T) {
+	conf := wal.Config{Enabled: true, Dir: t.TempDir(), Fsync: wal.FsyncNone}
+	orphan, err := wal.Open(shardWALConfig(conf, 5))
+	require.NoError(t, err)
+	require.NoError(t, orphan.Append(models.Measurement{DeviceID: uuid.New(), Value: 1}))
+	require.NoError(t, orphan.Close())
+
+	storage := &SlowStorage{}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, Shards: 2, WAL: conf}, storage)
+	buf.wal, err = wal.Open(conf)
+	require.NoError(t, err)
+	defer buf.Close()
+
+	require.NoError(t, buf.ReplayWAL())
+	require.Len(t, storage.Written, 1)
+	_, err = os.Stat(shardWALConfig(conf, 5).Dir)
+	require.True(t, os.IsNotExist(err))
+}
+
+func BenchmarkAddDatapointShards(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	devices := make([]uuid.UUID, 1000)
+	for i := range devices {
+		devices[i] = uuid.New()
+	}
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%v", shards), func(b *testing.B) {
+			buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 1024, WriteTimeout: 1, Shards: shards}, &MockStorage{})
+			go buf.RunDataHandler()
+			var n uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddUint64(&n, 1)
+					if err := buf.AddDatapoint(models.Measurement{DeviceID: devices[i%uint64(len(devices))], Value: float64(i)}); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+			b.StopTimer()
+			buf.Shutdown()
+		})
+	}
+}
+
+func (s *SlowStorage) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Written)
+}
+
+func TestFlushOnMaxAge(t *testing.T) {
+	storage := &SlowStorage{}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 100, WriteTimeout: 10, MaxAge: 50 * time.Millisecond}, storage)
+	go buf.RunDataHandler()
+	defer buf.Shutdown()
+
+	start := time.Now()
+	require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: uuid.New(), Timestamp: start}))
+	require.Eventually(t, func() bool { return storage.written() == 1 }, time.Second, 5*time.Millisecond)
+	require.Less(t, time.Since(start), time.Second)
+
+	// timer is armed again by the first datapoint after flush
+	require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: uuid.New(), Timestamp: start.Add(time.Second)}))
+	require.Eventually(t, func() bool { return storage.written() == 2 }, time.Second, 5*time.Millisecond)
+}
+
+func TestRetryFailedFlushOnMaxAge(t *testing.T) {
+	storage := &FailingStorage{Err: errors.New("connection refused")}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 100, WriteTimeout: 10, MaxAge: 20 * time.Millisecond,
+		Retry: RetryConfig{MaxAttempts: 1}}, storage)
+	go buf.RunDataHandler()
+	require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: uuid.New(), Timestamp: time.Now()}))
+	time.Sleep(200 * time.Millisecond)
+	buf.Shutdown()
+
+	// kept buffer is retried after MaxAge, long before WriteTimeout ticker
+	require.GreaterOrEqual(t, storage.Attempts, 3)
+	require.Len(t, buf.Buff, 1)
+}
+
+func TestFlushOnMaxBytes(t *testing.T) {
+	dp := models.Measurement{Metadata: map[string]interface{}{"fw": "1.0.2"}}
+	require.Equal(t, measurementFixedSize+2+2+4+7, DatapointSize(dp))
+
+	storage := &SlowStorage{}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 100, WriteTimeout: 10, MaxBytes: 3 * DatapointSize(dp)}, storage)
+	go buf.RunDataHandler()
+	for i := 0; i < 7; i++ {
+		dp.DeviceID = uuid.New()
+		require.NoError(t, buf.AddDatapoint(dp))
+	}
+	require.Eventually(t, func() bool { return storage.written() == 6 }, time.Second, 5*time.Millisecond)
+	buf.Shutdown()
+	require.Equal(t, []int{3, 3}, storage.Batches)
+}
+
+func TestWriteThroughAcks(t *testing.T) {
+	storage := &RejectingStorage{Bad: -1}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 100, WriteTimeout: 10, MaxAge: 20 * time.Millisecond}, storage)
+	go buf.RunDataHandler()
+
+	now := time.Now()
+	acks, err := buf.AddDatapointsSync([]models.Model{
+		models.Measurement{DeviceID: uuid.New(), Timestamp: now, Value: 1},
+		models.Measurement{DeviceID: uuid.New(), Timestamp: now, Value: -1},
+	}, PriorityNormal)
+	require.NoError(t, err)
+	require.Len(t, acks, 2)
+	require.NoError(t, acks[0].Wait(time.Second))
+	require.True(t, IsRowError(acks[1].Wait(time.Second)))
+	require.Len(t, storage.Written, 1)
+
+	buf.Shutdown()
+	ack, err := buf.AddDatapointSync(models.Measurement{DeviceID: uuid.New(), Timestamp: now}, PriorityNormal)
+	require.NoError(t, err)
+	require.Equal(t, ErrAckTimeout, ack.Wait(time.Millisecond))
+	require.NoError(t, buf.Close())
+	require.Equal(t, ErrNotWritten, ack.Wait(time.Second))
+}
+
+func TestShutdownInterruptsRetryBackoff(t *testing.T) {
+	storage := &FailingStorage{Err: errors.New("connection refused")}
+	buf := NewWriteBuffer(&WBufferConfig{BufMaxSize: 10, WriteTimeout: 10, MaxAge: time.Millisecond,
+		Retry: RetryConfig{MaxAttempts: 5, InitialBackoff: time.Minute}}, storage)
+	go buf.RunDataHandler()
+	require.NoError(t, buf.AddDatapoint(models.Measurement{DeviceID: uuid.New(), Timestamp: time.Now()}))
+	// flush fails and waits for the second attempt
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	buf.Shutdown()
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, 1, storage.Attempts)
+	require.Len(t, buf.Buff, 1)
+
+	// final flush after shutdown makes a single attempt
+	require.Error(t, buf.FlushBuffer())
+	require.Equal(t, 2, storage.Attempts)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -2,7 +2,27 @@ module github.com/qwlt/gmcollector
 
 go 1.17
 
-require github.com/google/uuid v1.3.0
+require (
+	github.com/eclipse/paho.mqtt.golang v1.3.5
+	github.com/gofiber/websocket/v2 v2.0.12
+	github.com/google/uuid v1.3.0
+	github.com/prometheus/client_golang v1.11.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/fasthttp/websocket v1.4.3-rc.9 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	github.com/savsgio/gotils v0.0.0-20210921075833-21a6215cb0e4 // indirect
+	golang.org/x/net v0.0.0-20210510120150-4163338589ed // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
+)
 
 require (
 	github.com/spf13/viper v1.9.0
@@ -32,13 +52,13 @@ require (
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/klauspost/compress v1.13.4 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.29.0 // indirect
+	github.com/valyala/fasthttp v1.30.0
 	github.com/valyala/tcplisten v1.0.0 // indirect
 )
 
 require (
 	github.com/jackc/chunkreader/v2 v2.0.1 // indirect
-	github.com/jackc/pgconn v1.10.0 // indirect
+	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pgio v1.0.0 // indirect
 	github.com/jackc/pgpassfile v1.0.0 // indirect
 	github.com/jackc/pgproto3/v2 v2.1.1 // indirect
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"os"
+
 	"github.com/qwlt/gmcollector/app"
+	"github.com/qwlt/gmcollector/app/cli"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(cli.Run(os.Args[1:]))
+	}
 	App := app.NewApplication("viper")
 	err := App.Init()
 	if err != nil {